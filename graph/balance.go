@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// 限制桶大小时为每个向量考虑的候选桶个数，候选桶都已满时放入最近的桶
+const balanceCandidates = 8
+
+// 更新均衡惩罚 每个中心的惩罚累加balance*scale乘以其点数与平均点数之比减1，penalty为nil时从0开始
+// scale为本轮每个点的平均代价，使balance与数据的尺度无关。惩罚按轮累加而不是只取上一轮的簇大小，
+// 持续偏大的簇惩罚逐渐增大，避免大小簇在相邻两轮间来回摆动
+func balancePenalty(penalty []float64, count []int, balance float64, scale float64) []float64 {
+	if penalty == nil {
+		penalty = make([]float64, len(count))
+	}
+	var total int
+	for _, size := range count {
+		total += size
+	}
+	if total == 0 {
+		return penalty
+	}
+	mean := float64(total) / float64(len(count))
+	for j, size := range count {
+		penalty[j] += balance * scale * (float64(size)/mean - 1)
+	}
+	return penalty
+}
+
+// bucketReport 分桶报告 before为每个向量都放入最近的桶时各桶的大小，after为限制桶大小后实际各桶的大小
+// overflow为候选桶都已满而超出上限放入最近桶的向量个数
+type bucketReport struct {
+	before   []int
+	after    []int
+	overflow int
+}
+
+// 新建num个桶的分桶报告
+func newBucketReport(num int) *bucketReport {
+	return &bucketReport{before: make([]int, num), after: make([]int, num)}
+}
+
+// 桶大小分布的摘要：最小、最大、平均、标准差与分位数
+func bucketStats(sizes []int) string {
+	if len(sizes) == 0 {
+		return "没有桶"
+	}
+	sorted := append([]int(nil), sizes...)
+	sort.Ints(sorted)
+	var sum, squares float64
+	for _, size := range sorted {
+		sum += float64(size)
+		squares += float64(size) * float64(size)
+	}
+	mean := sum / float64(len(sorted))
+	deviation := math.Sqrt(math.Max(squares/float64(len(sorted))-mean*mean, 0))
+	percentile := func(p float64) int {
+		return sorted[minInt(int(p*float64(len(sorted))), len(sorted)-1)]
+	}
+	return fmt.Sprintf("最小%d, 最大%d, 平均%.1f, 标准差%.1f, p50 %d, p90 %d, p99 %d",
+		sorted[0], sorted[len(sorted)-1], mean, deviation, percentile(0.5), percentile(0.9), percentile(0.99))
+}
+
+// 返回分桶前后桶大小分布的对比
+func (pointer *bucketReport) String() string {
+	return fmt.Sprintf("分桶前: %s\n分桶后: %s\n超出上限%d个", bucketStats(pointer.before), bucketStats(pointer.after), pointer.overflow)
+}
+
+// 按度量m为矩阵rows的每一行找到最近的r个桶，按距离由近到远排列；未建立hnsw图时用分块内核批量计算
+func (pointer *hnswQuantizer) candidates(center *floatMatrix, rows *floatMatrix, r int, m Metric) [][]int {
+	if pointer.graph == nil {
+		return nearestRowsTop(rows, center, m, r)
+	}
+	result := make([][]int, rows.rows)
+	for i := range result {
+		for _, bucket := range pointer.nearestBuckets(center, *rows.vectorAt(i), r, m) {
+			result[i] = append(result[i], bucket.index)
+		}
+	}
+	return result
+}
+
+// 限制桶大小地分桶：每个向量按与聚心由近到远的顺序放入第一个未满的桶，maxSize不大于0时不限制
+// report记录分桶前后的桶大小，跨文件累计
+func assignBalanced(quantizer *hnswQuantizer, center *floatMatrix, rows *floatMatrix, m Metric, maxSize int, report *bucketReport) []int {
+	result := make([]int, rows.rows)
+	for i, list := range quantizer.candidates(center, rows, balanceCandidates, m) {
+		chosen := list[0]
+		report.before[chosen]++
+		if maxSize > 0 && report.after[chosen] >= maxSize {
+			full := true
+			for _, bucket := range list[1:] {
+				if report.after[bucket] < maxSize {
+					chosen, full = bucket, false
+					break
+				}
+			}
+			if full {
+				report.overflow++
+			}
+		}
+		report.after[chosen]++
+		result[i] = chosen
+	}
+	return result
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+)
+
+// binaryVector 按位压缩存储的二值向量，length为位数，第i位存放在bits[i/64]的第i%64位
+type binaryVector struct {
+	bits   []uint64
+	length int
+}
+
+// NewBinaryVector 向外生产一个length位的全零二值向量
+func NewBinaryVector(length int) *binaryVector {
+	return &binaryVector{bits: make([]uint64, binaryWords(length)), length: length}
+}
+
+// 存放length位需要的uint64个数
+func binaryWords(length int) int {
+	return (length + 63) / 64
+}
+
+// 把第i位设为1
+func (pointer *binaryVector) setBit(i int) {
+	pointer.bits[i/64] |= 1 << uint(i%64)
+}
+
+// 第i位是否为1
+func (pointer *binaryVector) getBit(i int) bool {
+	return pointer.bits[i/64]&(1<<uint(i%64)) != 0
+}
+
+// 与另一个二值向量的汉明距离
+func (pointer *binaryVector) hamming(input binaryVector) int {
+	return hamming(pointer.bits, input.bits)
+}
+
+// 将二值向量转化为十六进制字符串，高位在前，与读取格式一致
+func (pointer *binaryVector) toHex() string {
+	return bitsToHex(pointer.bits, pointer.length)
+}
+
+// 两个等长压缩位串的汉明距离，用popcount逐字计算
+func hamming(a []uint64, b []uint64) int {
+	b = b[:len(a)]
+	distance := 0
+	for i, word := range a {
+		distance += bits.OnesCount64(word ^ b[i])
+	}
+	return distance
+}
+
+// 把length位的压缩位串按每字节高位在前的顺序转化为十六进制字符串
+func bitsToHex(words []uint64, length int) string {
+	bytes := make([]byte, (length+7)/8)
+	for i := 0; i < length; i++ {
+		if words[i/64]&(1<<uint(i%64)) != 0 {
+			bytes[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// stringToBinary 将字符串转换为二值向量，length为位数
+// 只有一列时按十六进制解析（每字节高位在前），否则每列为一位，取值为0或1
+func stringToBinary(data []string, length int) (*binaryVector, error) {
+	vector := NewBinaryVector(length)
+	if len(data) == 1 {
+		bytes, err := hex.DecodeString(data[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes) != (length+7)/8 {
+			return nil, errors.New("二值向量位数与初始化位数不匹配")
+		}
+		for i := 0; i < length; i++ {
+			if bytes[i/8]&(1<<uint(7-i%8)) != 0 {
+				vector.setBit(i)
+			}
+		}
+		return vector, nil
+	}
+	if len(data) != length {
+		return nil, errors.New("二值向量位数与初始化位数不匹配")
+	}
+	for i, element := range data {
+		switch element {
+		case "1":
+			vector.setBit(i)
+		case "0":
+		default:
+			return nil, fmt.Errorf("第%d位不是0或1: %s", i, element)
+		}
+	}
+	return vector, nil
+}
+
+// binaryMatrix 行优先连续存储的二值向量组，每行words个uint64，length为每行位数
+type binaryMatrix struct {
+	data   []uint64
+	rows   int
+	words  int
+	length int
+}
+
+// NewBinaryMatrix 向外生产一个rows行、每行length位的二值矩阵
+func NewBinaryMatrix(rows int, length int) *binaryMatrix {
+	words := binaryWords(length)
+	return &binaryMatrix{data: make([]uint64, rows*words), rows: rows, words: words, length: length}
+}
+
+// 返回第i行，与矩阵共享内存
+func (pointer *binaryMatrix) row(i int) []uint64 {
+	return pointer.data[i*pointer.words : (i+1)*pointer.words : (i+1)*pointer.words]
+}
+
+// 在末尾增加一行
+func (pointer *binaryMatrix) appendRow(input []uint64) error {
+	if len(input) != pointer.words {
+		return errors.New("输入二值向量位数与初始化位数不匹配")
+	}
+	pointer.data = append(pointer.data, input...)
+	pointer.rows++
+	return nil
+}
+
+// 在末尾增加另一个矩阵的所有行
+func (pointer *binaryMatrix) appendMatrix(input *binaryMatrix) error {
+	if input.length != pointer.length {
+		return errors.New("输入二值向量位数与初始化位数不匹配")
+	}
+	pointer.data = append(pointer.data, input.data...)
+	pointer.rows += input.rows
+	return nil
+}
+
+// 把第i行转化为binaryVector
+func (pointer *binaryMatrix) vectorAt(i int) *binaryVector {
+	vector := NewBinaryVector(pointer.length)
+	copy(vector.bits, pointer.row(i))
+	return vector
+}
+
+// 返回第i行的十六进制字符串
+func (pointer *binaryMatrix) rowHex(i int) string {
+	return bitsToHex(pointer.row(i), pointer.length)
+}
+
+// 一个查询q对矩阵每一行求汉明距离，结果写入out
+func (pointer *binaryMatrix) hammingRows(q []uint64, out []int) {
+	for i := 0; i < pointer.rows; i++ {
+		out[i] = hamming(q, pointer.row(i))
+	}
+}
+
+// 矩阵中与q汉明距离最小的行，返回其行号与距离，矩阵为空时返回-1
+func (pointer *binaryMatrix) nearestRow(q []uint64) (int, int) {
+	minIndex, minDistance := -1, 0
+	for i := 0; i < pointer.rows; i++ {
+		distance := hamming(q, pointer.row(i))
+		if minIndex < 0 || distance < minDistance {
+			minIndex, minDistance = i, distance
+		}
+	}
+	return minIndex, minDistance
+}
+
+// loadBinaryData 载入二值向量文件，每行为一个向量，length为位数
+func loadBinaryData(path string, length int) (*binaryMatrix, error) {
+	_, vectors, err := loadBinaryFile(path, length, false)
+	return vectors, err
+}
+
+// loadBinaryBucket 载入二值向量桶，每行第一列为编号，其余为向量
+func loadBinaryBucket(path string, length int) (indexs []int, vectors *binaryMatrix, err error) {
+	return loadBinaryFile(path, length, true)
+}
+
+// 读取二值向量csv文件，withIndex表示第一列为编号
+func loadBinaryFile(path string, length int, withIndex bool) (indexs []int, vectors *binaryMatrix, err error) {
+	csvFile, err := os.Open(path)
+	if err != nil {
+		fmt.Print("文件似乎不存在")
+		return nil, nil, errors.New("Load file error")
+	}
+	defer csvFile.Close()
+	indexs = make([]int, 0)
+	vectors = NewBinaryMatrix(0, length)
+	csvReader := csv.NewReader(csvFile)
+	csvReader.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		inputString, readerError := csvReader.Read()
+		if readerError == io.EOF {
+			break
+		}
+		if readerError != nil {
+			return nil, nil, readerError
+		}
+		if withIndex {
+			index, err := strconv.Atoi(inputString[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s第%d行编号错误: %v", path, line, err)
+			}
+			indexs = append(indexs, index)
+			inputString = inputString[1:]
+		}
+		vector, err := stringToBinary(inputString, length)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s第%d行: %v", path, line, err)
+		}
+		vectors.appendRow(vector.bits)
+	}
+	return indexs, vectors, nil
+}
+
+// 把二值矩阵写成csv，每行为编号与十六进制字符串，ids为nil时编号为行号
+// appendMode表示追加到已有文件末尾，否则覆盖
+func writeBinaryFile(path string, ids []int, vectors *binaryMatrix, appendMode bool) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendMode {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	outputFile, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	outputWriter := csv.NewWriter(outputFile)
+	for i := 0; i < vectors.rows; i++ {
+		id := i
+		if ids != nil {
+			id = ids[i]
+		}
+		if err := outputWriter.Write([]string{strconv.Itoa(id), vectors.rowHex(i)}); err != nil {
+			return err
+		}
+	}
+	outputWriter.Flush()
+	return outputWriter.Error()
+}
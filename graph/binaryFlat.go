@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// BinaryFlat 二值向量的暴力检索索引，按汉明距离逐一比较，适用于去重指纹等数据量不大的场景
+// length为向量位数，ids为每一行的外部编号，rows为外部编号到行号的映射，nextID为createIndex分配的下一个外部编号，只增不减
+// mu保护ids、rows与vectors，插入持写锁，查询持读锁
+type BinaryFlat struct {
+	length  int
+	ids     []int
+	rows    map[int]int
+	nextID  int
+	vectors *binaryMatrix
+	mu      sync.RWMutex
+}
+
+// NewBinaryFlat 向外生产一个length位的二值暴力索引
+func NewBinaryFlat(length int) *BinaryFlat {
+	return &BinaryFlat{length: length, ids: make([]int, 0), rows: make(map[int]int), vectors: NewBinaryMatrix(0, length)}
+}
+
+// 建立索引 path为二值向量csv文件路径，向量的外部编号从nextID起依次分配，不会与已有编号重复
+func (pointer *BinaryFlat) createIndex(path string) error {
+	vectors, err := loadBinaryData(path, pointer.length)
+	if err != nil {
+		return err
+	}
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	if err := pointer.vectors.appendMatrix(vectors); err != nil {
+		return err
+	}
+	start := pointer.nextID
+	for i := 0; i < vectors.rows; i++ {
+		pointer.appendID(start + i)
+	}
+	return nil
+}
+
+// Add 插入一个二值向量，id为向量的外部编号，不能与已有编号重复
+func (pointer *BinaryFlat) Add(id int, vector binaryVector) error {
+	if vector.length != pointer.length {
+		return errors.New("输入二值向量位数与索引位数不匹配")
+	}
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	if _, ok := pointer.rows[id]; ok {
+		return fmt.Errorf("编号%d已存在", id)
+	}
+	if err := pointer.vectors.appendRow(vector.bits); err != nil {
+		return err
+	}
+	pointer.appendID(id)
+	return nil
+}
+
+// 记录新追加的一行的外部编号，调用者需持有写锁并已检查编号不重复
+func (pointer *BinaryFlat) appendID(id int) {
+	if pointer.rows == nil {
+		pointer.rows = make(map[int]int)
+	}
+	pointer.rows[id] = len(pointer.ids)
+	pointer.ids = append(pointer.ids, id)
+	if id >= pointer.nextID {
+		pointer.nextID = id + 1
+	}
+}
+
+// 存储索引 path为csv文件路径，每行为外部编号与十六进制向量
+func (pointer *BinaryFlat) storeIndex(path string) error {
+	pointer.mu.RLock()
+	defer pointer.mu.RUnlock()
+	return writeBinaryFile(path, pointer.ids, pointer.vectors, false)
+}
+
+// 加载storeIndex生成的索引
+func (pointer *BinaryFlat) loadIndex(path string) error {
+	ids, vectors, err := loadBinaryBucket(path, pointer.length)
+	if err != nil {
+		return err
+	}
+	rows, nextID := make(map[int]int, len(ids)), 0
+	for i, id := range ids {
+		if _, ok := rows[id]; ok {
+			return fmt.Errorf("编号%d重复", id)
+		}
+		rows[id] = i
+		if id >= nextID {
+			nextID = id + 1
+		}
+	}
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	pointer.ids, pointer.rows, pointer.nextID, pointer.vectors = ids, rows, nextID, vectors
+	return nil
+}
+
+// 查找与输入向量汉明距离最小的k个向量，返回结果的index为外部编号，
+// distance为汉明距离的相反数（越大越近），按距离由近到远排列
+func (pointer *BinaryFlat) searchVector(inputVector binaryVector, k int) []searchResult {
+	if inputVector.length != pointer.length {
+		fmt.Print("输入二值向量位数与索引位数不匹配")
+		return nil
+	}
+	pointer.mu.RLock()
+	defer pointer.mu.RUnlock()
+	distances := make([]int, pointer.vectors.rows)
+	pointer.vectors.hammingRows(inputVector.bits, distances)
+	nearest := &resultHeap{nearest: false}
+	for i, distance := range distances {
+		nearest.pushTop(searchResult{index: pointer.ids[i], distance: float64(-distance)}, k)
+	}
+	return nearest.sorted()
+}
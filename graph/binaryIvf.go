@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// k-majority聚类的最大迭代次数，分配不再变化时提前结束
+const binaryIterations = 100
+
+// BinaryIvf 二值向量的倒排索引，沿用Kmeans的桶目录结构：每个桶一个csv文件，每行为编号与十六进制向量，
+// center.csv为聚心。聚心由k-majority聚类得到，每一位取簇内多数向量在该位的取值
+// length为向量位数, random为采样与初始化聚心使用的随机数生成器, nprobe为查找时搜索的桶个数
+type BinaryIvf struct {
+	length int
+	center *binaryMatrix
+	random *rand.Rand
+	nprobe int
+}
+
+// NewBinaryIvf 向外生产一个length位的二值倒排索引，默认以当前时间为随机种子
+func NewBinaryIvf(length int) *BinaryIvf {
+	return &BinaryIvf{length: length, random: newTimeRand()}
+}
+
+// 设置随机种子，种子相同且数据相同时建立的索引完全一致
+func (pointer *BinaryIvf) setSeed(seed int64) {
+	pointer.random = newRand(seed)
+}
+
+// 设置查找时搜索的桶个数
+func (pointer *BinaryIvf) setNprobe(nprobe int) {
+	pointer.nprobe = nprobe
+}
+
+// 建立索引 dataPath为二值向量csv文件目录，num为聚簇点个数
+func (pointer *BinaryIvf) createIndex(dataPath string, num int) error {
+	rd, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return err
+	}
+	sampling := num * 256 / len(rd)
+	// 每个文件的采样结果放在各自的位置，最后按文件顺序合并，保证采样结果与加载顺序无关
+	samples := make([]*binaryMatrix, len(rd))
+	var wg sync.WaitGroup
+	sem := make(semaphore, 2)
+	for i, fi := range rd {
+		sem.P(1)
+		wg.Add(1)
+		go func(i int, path string, random *rand.Rand) {
+			defer wg.Done()
+			defer sem.V(1)
+			samples[i] = NewBinaryMatrix(0, pointer.length)
+			data, err := loadBinaryData(dataPath+"/"+path, pointer.length)
+			if err != nil {
+				fmt.Print(err)
+				return
+			}
+			count := minInt(sampling, data.rows)
+			if count < sampling {
+				fmt.Print("数据量过少,请减少聚簇点数")
+			}
+			for _, index := range random.Perm(data.rows)[:count] {
+				samples[i].appendRow(data.row(index))
+			}
+		}(i, fi.Name(), newRand(pointer.random.Int63()))
+	}
+	wg.Wait()
+	vectors := NewBinaryMatrix(0, pointer.length)
+	for _, sample := range samples {
+		vectors.appendMatrix(sample)
+	}
+	if vectors.rows < num {
+		return errors.New("采样点个数少于聚簇点个数")
+	}
+	pointer.center = searchBinaryCenter(num, vectors, pointer.random)
+	return nil
+}
+
+// k-majority聚类 num表示聚类点数 vectors表示采样点 random用于选取初始聚簇中心
+// 每轮按汉明距离分配采样点，再把聚心的每一位设为簇内多数向量的取值，票数相同或空簇时保留原值
+func searchBinaryCenter(num int, vectors *binaryMatrix, random *rand.Rand) *binaryMatrix {
+	center := NewBinaryMatrix(num, vectors.length)
+	for i, index := range random.Perm(vectors.rows)[:num] {
+		copy(center.row(i), vectors.row(index))
+	}
+	neighbor := make([]int, vectors.rows)
+	for i := range neighbor {
+		neighbor[i] = -1
+	}
+	for iteration := 0; iteration < binaryIterations; iteration++ {
+		changed := 0
+		for index := 0; index < vectors.rows; index++ {
+			nearest, _ := center.nearestRow(vectors.row(index))
+			if nearest != neighbor[index] {
+				neighbor[index] = nearest
+				changed++
+			}
+		}
+		if changed == 0 {
+			break
+		}
+		// ones[j][b]为第j个簇在第b位为1的向量个数
+		count := make([]int, num)
+		ones := make([][]int, num)
+		for j := range ones {
+			ones[j] = make([]int, vectors.length)
+		}
+		for index, neigh := range neighbor {
+			count[neigh]++
+			for w, word := range vectors.row(index) {
+				for word != 0 {
+					b := bits.TrailingZeros64(word)
+					ones[neigh][w*64+b]++
+					word &= word - 1
+				}
+			}
+		}
+		for j := 0; j < num; j++ {
+			row := center.row(j)
+			for b, one := range ones[j] {
+				mask := uint64(1) << uint(b%64)
+				if 2*one > count[j] {
+					row[b/64] |= mask
+				} else if 2*one < count[j] {
+					row[b/64] &^= mask
+				}
+			}
+		}
+		fmt.Printf("k-majority第%d轮, %d个点改变了所属聚簇\n", iteration, changed)
+	}
+	return center
+}
+
+// 储存索引 dataPath为二值向量csv文件目录，bucketPath为桶目录，向量编号为其在按数值排序后的文件中的顺序
+func (pointer *BinaryIvf) storeIndex(dataPath string, bucketPath string) error {
+	if pointer.center == nil {
+		return errors.New("聚类算法尚未运行")
+	}
+	rd, err := ioutil.ReadDir(dataPath)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(bucketPath, os.ModePerm)
+	if err != nil {
+		fmt.Print("bucket 已经加载")
+	}
+	listDirs := make([]string, 0)
+	for _, fi := range rd {
+		listDirs = append(listDirs, fi.Name())
+	}
+	listDirs = dirSort(listDirs)
+	// 记录总数 因为是多个文件
+	count := 0
+	for _, listDir := range listDirs {
+		data, err := loadBinaryData(dataPath+"/"+listDir, pointer.length)
+		if err != nil {
+			return err
+		}
+		bucket := make([]*binaryMatrix, pointer.center.rows)
+		bucketIdentifier := make([][]int, pointer.center.rows)
+		for i := range bucket {
+			bucket[i] = NewBinaryMatrix(0, pointer.length)
+		}
+		for i := 0; i < data.rows; i++ {
+			nearest, _ := pointer.center.nearestRow(data.row(i))
+			bucket[nearest].appendRow(data.row(i))
+			bucketIdentifier[nearest] = append(bucketIdentifier[nearest], i+count)
+		}
+		count += data.rows
+		for i := range bucket {
+			if err := writeBinaryFile(bucketPath+"/"+strconv.Itoa(i)+".csv", bucketIdentifier[i], bucket[i], true); err != nil {
+				return err
+			}
+		}
+	}
+	// 存储中心点
+	return writeBinaryFile(bucketPath+"/center.csv", nil, pointer.center, false)
+}
+
+// 查找与输入向量汉明距离最小的k个向量 root为桶目录
+// 返回结果的index为向量编号，distance为汉明距离的相反数（越大越近），按距离由近到远排列
+func (pointer *BinaryIvf) searchVector(inputVector binaryVector, root string, k int) []searchResult {
+	if inputVector.length != pointer.length {
+		fmt.Print("输入二值向量位数与索引位数不匹配")
+		return nil
+	}
+	// 如果还没有聚簇点，那么加载聚簇点
+	if pointer.center == nil {
+		_, center, err := loadBinaryBucket(root+"/center.csv", pointer.length)
+		if err != nil {
+			fmt.Print(err)
+			return nil
+		}
+		pointer.center = center
+	}
+	// 找到最近的nprobe个桶
+	nprobe := pointer.nprobe
+	if nprobe < 1 {
+		nprobe = 1
+	}
+	distances := make([]int, pointer.center.rows)
+	pointer.center.hammingRows(inputVector.bits, distances)
+	buckets := make([]int, pointer.center.rows)
+	for i := range buckets {
+		buckets[i] = i
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		return distances[buckets[i]] < distances[buckets[j]]
+	})
+	if len(buckets) > nprobe {
+		buckets = buckets[:nprobe]
+	}
+	nearest := &resultHeap{nearest: false}
+	for _, bucket := range buckets {
+		indexs, vectors, err := loadBinaryBucket(root+"/"+strconv.Itoa(bucket)+".csv", pointer.length)
+		if err != nil {
+			fmt.Print(err)
+			continue
+		}
+		bucketDistances := make([]int, vectors.rows)
+		vectors.hammingRows(inputVector.bits, bucketDistances)
+		for i, distance := range bucketDistances {
+			nearest.pushTop(searchResult{index: indexs[i], distance: float64(-distance)}, k)
+		}
+	}
+	return nearest.sorted()
+}
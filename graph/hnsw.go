@@ -1,19 +1,39 @@
 package main
 
 import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
 )
 
-// hnswVectors hnsw算法的向量组，layer表示所在最高层数, index 表示表头编号
+// hnsw索引文件的魔数与版本号，文件格式改变时需要增加版本号
+const (
+	hnswMagic   = "HNSW"
+	hnswVersion = 7
+	// 估计过滤条件选择率时抽查的结点数
+	hnswFilterSample = 1000
+)
+
+// hnswVectors hnsw算法的结点，layer表示所在最高层数, index 表示表头编号, id 表示向量的外部编号
+// deleted 表示该向量已被删除（墓碑），搜索时仍可经过但不会返回；向量本身存放在Hnsw的vectors矩阵的第index行
 type hnswVector struct{
 	layer int
 	index int
-	floatVector
+	id int
+	deleted bool
 }
 // NewHnswVector 生产一个hnswvector
-func NewHnswVector(layer int, index int, vector floatVector) *hnswVector{
-	return &hnswVector{layer: layer, index: index, floatVector: vector}
+func NewHnswVector(layer int, index int) *hnswVector{
+	return &hnswVector{layer: layer, index: index}
 }
 
 type hnswVectors struct{
@@ -21,9 +41,80 @@ type hnswVectors struct{
 	length     int
 }
 
-//Hnsw 算法, M为结点的度, ef 为动态表大小, ml为归一化因子,data表示存储这些结构的数据,graph是图的邻接表，
+// Append 往hnsw向量组内增加向量
+func (pointer *hnswVectors) Append(input hnswVector) {
+	pointer.vectors = append(pointer.vectors, input)
+	pointer.length++
+}
+
+// searchResult 搜索结果，index为向量编号，distance为与查询向量的距离（越大越近）
+type searchResult struct{
+	index    int
+	distance float64
+}
+
+// resultHeap 搜索使用的堆，nearest为true时堆顶为最近点，否则堆顶为最远点
+type resultHeap struct{
+	items   []searchResult
+	nearest bool
+}
+
+func (pointer *resultHeap) Len() int { return len(pointer.items) }
+func (pointer *resultHeap) Less(i, j int) bool {
+	if pointer.nearest {
+		return pointer.items[i].distance > pointer.items[j].distance
+	}
+	return pointer.items[i].distance < pointer.items[j].distance
+}
+func (pointer *resultHeap) Swap(i, j int) {
+	pointer.items[i], pointer.items[j] = pointer.items[j], pointer.items[i]
+}
+func (pointer *resultHeap) Push(x interface{}) {
+	pointer.items = append(pointer.items, x.(searchResult))
+}
+func (pointer *resultHeap) Pop() interface{} {
+	last := pointer.items[len(pointer.items)-1]
+	pointer.items = pointer.items[:len(pointer.items)-1]
+	return last
+}
+
+// top 返回堆顶元素
+func (pointer *resultHeap) top() searchResult {
+	return pointer.items[0]
+}
+
+// pushTop 向以最远点为堆顶的堆中加入结果，只保留最近的k个
+func (pointer *resultHeap) pushTop(item searchResult, k int) {
+	if pointer.Len() < k {
+		heap.Push(pointer, item)
+		return
+	}
+	if k > 0 && item.distance > pointer.top().distance {
+		pointer.items[0] = item
+		heap.Fix(pointer, 0)
+	}
+}
+
+// sorted 取出以最远点为堆顶的堆中所有结果，按距离由近到远排列
+func (pointer *resultHeap) sorted() []searchResult {
+	result := make([]searchResult, pointer.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(pointer).(searchResult)
+	}
+	return result
+}
+
+//Hnsw 算法, M为结点的度, ef 为动态表大小, ml为归一化因子,data表示存储这些结构的数据,vectors按表头编号连续存放向量,graph是图的邻接表，
 //第一维表示每个点，第二维表示某一层，第三维表示某一层的某一个邻接点
 // 单元素都直接传向量本身，多元素就传索引数组[]int
+// heuristic表示是否使用启发式选邻居，extendCandidates与keepPrunedConnections为启发式的两个选项
+// ids 为外部编号到未删除向量表头编号的映射, deleted 为墓碑个数, nextID 为createIndex分配的下一个外部编号，只增不减
+// 并发控制：mu保护结点表（data、graph的第一维、ids等），查询与连接单个结点持读锁，增加结点、删除与压缩持写锁；
+// locks为每个结点邻接表的锁；epMu保护入口点ep与最高层L，以及pending；workers为并行插入的协程数
+// pending为已分配结点但尚未开始连接的外部编号，这些结点没有邻居，压缩时不能作为入口点，保存时一并写入，加载后再连接
+// random为抽取结点层级使用的随机数生成器，metric为距离度量
+// pca为放在索引之前的降维变换，为nil表示不降维，插入与查询的向量都先经过它
+// ingest为createIndex读取csv数据的严格载入设置，为nil时宽松载入
 type Hnsw struct{
 	M int
 	ef int
@@ -32,81 +123,891 @@ type Hnsw struct{
 	ep hnswVector
 	graph [][][]int
 	data hnswVectors
+	vectors *floatMatrix
+	ids map[int]int
+	deleted int
+	nextID int
+	pending map[int]bool
+	heuristic bool
+	extendCandidates bool
+	keepPrunedConnections bool
+	workers int
+	random *rand.Rand
+	metric Metric
+	mu sync.RWMutex
+	epMu sync.Mutex
+	locks []*sync.Mutex
+	pca *PCA
+	ingest *ingestOptions
+}
+
+// NewHnsw 向外生产一个Hnsw, M为结点的度, ef为建图时的动态表大小
+func NewHnsw(M int, ef int) *Hnsw {
+	return &Hnsw{M: M, ef: ef, ml: 1 / math.Log(float64(M)), ids: make(map[int]int), workers: runtime.NumCPU(), random: newTimeRand()}
+}
+
+// 设置距离度量，需在插入向量前设置
+func(pointer *Hnsw) setMetric(m Metric) {
+	pointer.metric = m
+}
+
+// 设置随机种子，结点层级的抽取将可复现；
+// 并行插入时图结构还与协程调度有关，需要完全可复现时应同时把workers设为1
+func(pointer *Hnsw) setSeed(seed int64) {
+	pointer.random = newRand(seed)
 }
 
+// 改用启发式选邻居（HNSW论文算法4），extendCandidates表示用候选点的邻居扩充候选集,
+// keepPrunedConnections表示用被舍弃的点补足M个邻居
+func(pointer *Hnsw) useHeuristic(extendCandidates bool, keepPrunedConnections bool) {
+	pointer.heuristic = true
+	pointer.extendCandidates = extendCandidates
+	pointer.keepPrunedConnections = keepPrunedConnections
+}
+
+// 在索引之前加入降维变换，随索引一起保存。未训练时由createIndex或AddBatch在第一批数据上训练，
+// 训练之前Add单个向量会返回错误
+func(pointer *Hnsw) usePCA(pca *PCA) {
+	pointer.pca = pca
+}
+
+// 读取csv数据时严格检查，按options报告或跳过格式错误、维度错误、非有限值与零向量
+func(pointer *Hnsw) useStrictIngest(options *ingestOptions) {
+	pointer.ingest = options
+}
+
+// 建立索引 path为csv数据路径, length为向量维度, 向量的外部编号从nextID起依次分配，
+// 删除与压缩后也不会与已有编号重复
 func(pointer *Hnsw) createIndex(path string, length int) {
-	floatData, err := loadData(path, length)
+	rows, err := loadDataWith(path, length, pointer.ingest)
 	if err != nil{
 		fmt.Print(err)
+		return
+	}
+	pointer.mu.RLock()
+	start := pointer.nextID
+	pointer.mu.RUnlock()
+	ids := make([]int, rows.rows)
+	for i := range ids {
+		ids[i] = start + i
+	}
+	rows, err = pointer.pca.fitApply(rows, pointer.random)
+	if err != nil {
+		fmt.Print(err)
+		return
+	}
+	if err := pointer.addRows(ids, rows); err != nil {
+		fmt.Print(err)
+	}
+}
+
+// Add 向已有的图中增量插入一个向量，id为向量的外部编号，不能与已有编号重复
+// 可与其他插入、查询并发调用，设置了降维变换时须先用createIndex或AddBatch训练，否则返回错误
+func(pointer *Hnsw) Add(id int, vector floatVector) error {
+	vector, err := pointer.pca.applyVector(vector)
+	if err != nil {
+		return err
+	}
+	rows, err := vectorsToMatrix([]floatVector{vector})
+	if err != nil {
+		return err
+	}
+	ids, err := pointer.reserve([]int{id}, rows)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		pointer.connectID(id)
+	}
+	return nil
+}
+
+// AddBatch 用workers个协程并行插入一批向量，ids与vectors一一对应
+func(pointer *Hnsw) AddBatch(ids []int, vectors []floatVector) error {
+	if len(ids) != len(vectors) {
+		return errors.New("编号个数与向量个数不匹配")
+	}
+	rows, err := vectorsToMatrix(vectors)
+	if err != nil {
+		return err
+	}
+	rows, err = pointer.pca.fitApply(rows, pointer.random)
+	if err != nil {
+		return err
+	}
+	return pointer.addRows(ids, rows)
+}
+
+// 用workers个协程并行插入矩阵的每一行，ids与行一一对应
+// 每个结点单独持读锁连接，删除与压缩可以在两个结点之间进行，不会让查询等待整批插入结束
+func(pointer *Hnsw) addRows(ids []int, rows *floatMatrix) error {
+	if len(ids) != rows.rows {
+		return errors.New("编号个数与向量个数不匹配")
+	}
+	pendingIDs, err := pointer.reserve(ids, rows)
+	if err != nil {
+		return err
+	}
+	workers := pointer.workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	var wg sync.WaitGroup
+	sem := make(semaphore, workers)
+	for _, id := range pendingIDs {
+		sem.P(1)
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			defer sem.V(1)
+			pointer.connectID(id)
+		}(id)
 	}
-	for i, data := range(floatData){
+	wg.Wait()
+	return nil
+}
+
+// 为一批向量分配结点并抽取层级，返回需要连接到图中的外部编号，并把它们记入pending
+// 返回外部编号而不是表头编号，因为连接之前压缩可能已经重新编号。图为空时第一个结点直接作为入口点，无需连接
+func(pointer *Hnsw) reserve(ids []int, rows *floatMatrix) ([]int, error) {
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	if pointer.ids == nil {
+		pointer.ids = make(map[int]int)
+	}
+	if pointer.pending == nil {
+		pointer.pending = make(map[int]bool)
+	}
+	if pointer.random == nil {
+		pointer.random = newTimeRand()
+	}
+	if rows.rows == 0 {
+		return nil, nil
+	}
+	if pointer.data.length > 0 && rows.dim != pointer.vectors.dim {
+		return nil, errors.New("输入特征维度与索引维度不匹配")
+	}
+	batch := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if _, ok := pointer.ids[id]; ok || batch[id] {
+			return nil, fmt.Errorf("编号%d已存在", id)
+		}
+		batch[id] = true
+	}
+	if pointer.vectors == nil || pointer.data.length == 0 {
+		pointer.vectors = NewFloatMatrix(0, rows.dim)
+	}
+	pointer.vectors.appendMatrix(rows)
+	pendingIDs := make([]int, 0, len(ids))
+	for _, id := range ids {
 		// 表示该数据层级
-		// flag true表示 L大于pointer.L
-		flag := false
-		layer := int(math.Floor(-math.Log(getRandFloat64())*pointer.ml))
-		if layer > pointer.L{
-			pointer.L = layer
-			flag = true
-		}
-		vector := NewFloatVector(length)
-		vector.SetVector(data)
-		q := NewHnswVector(layer, i, *vector)
-		ep := pointer.ep
-		for i := pointer.L; i >layer; i--{
-			W := pointer.searchLayer(*q, ep, i)
-			ep = pointer.selectNeigh(*q, W, pointer.M).vectors[0]
-		}
-		var neighbors hnswVectors
-		for ;i >= 0; i--{
-			W := pointer.searchLayer(*q, ep, i)
-			neighbors = pointer.selectNeigh(*q, W, pointer.M)
-			for _, e := range(neighbors.vectors){
-				pointer.link(e, *q, i)
-				pointer.prune(e, i)
-			}
-			ep = neighbors.vectors[0]
-		}
-		if flag == true{
-			flag = false
+		layer := int(math.Floor(-math.Log(getRandFloat64(pointer.random))*pointer.ml))
+		q := NewHnswVector(layer, pointer.data.length)
+		q.id = id
+		pointer.ids[id] = q.index
+		if id >= pointer.nextID {
+			pointer.nextID = id + 1
+		}
+		pointer.data.Append(*q)
+		pointer.graph = append(pointer.graph, make([][]int, layer+1))
+		pointer.locks = append(pointer.locks, new(sync.Mutex))
+		// 第一个点直接作为入口点
+		if q.index == 0 {
 			pointer.ep = *q
+			pointer.L = layer
+			continue
+		}
+		pointer.pending[id] = true
+		pendingIDs = append(pendingIDs, id)
+	}
+	return pendingIDs, nil
+}
+
+// 持读锁连接外部编号为id的结点，结点已被删除或已由其他调用连接时什么也不做
+func(pointer *Hnsw) connectID(id int) {
+	pointer.mu.RLock()
+	defer pointer.mu.RUnlock()
+	pointer.epMu.Lock()
+	index, ok := pointer.ids[id]
+	ok = ok && pointer.pending[id]
+	delete(pointer.pending, id)
+	pointer.epMu.Unlock()
+	if ok {
+		pointer.connect(index)
+	}
+}
+
+// Delete 删除编号为id的向量，只打上墓碑标记，搜索立即不再返回该向量，
+// 图结构由Compact修复
+func(pointer *Hnsw) Delete(id int) error {
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	index, ok := pointer.ids[id]
+	if !ok {
+		return fmt.Errorf("编号%d不存在", id)
+	}
+	pointer.data.vectors[index].deleted = true
+	delete(pointer.ids, id)
+	delete(pointer.pending, id)
+	pointer.deleted++
+	return nil
+}
+
+// Compact 修复并压缩图：把指向墓碑的邻居重新连接到墓碑的邻居上，
+// 然后移除所有墓碑并重新编号，入口点被删除时重新选取最高层的结点作为入口点
+func(pointer *Hnsw) Compact() {
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	if pointer.deleted == 0 {
+		return
+	}
+	// 修复每个存活结点在每一层中指向墓碑的邻接表
+	for i, layers := range pointer.graph {
+		e := pointer.data.vectors[i]
+		if e.deleted {
+			continue
+		}
+		for lc, neighbors := range layers {
+			broken := false
+			for _, neigh := range neighbors {
+				if pointer.data.vectors[neigh].deleted {
+					broken = true
+					break
+				}
+			}
+			if !broken {
+				continue
+			}
+			// 候选集为存活邻居以及墓碑邻居的存活邻居
+			seen := map[int]bool{i: true}
+			candidates := make([]int, 0)
+			for _, neigh := range neighbors {
+				if !pointer.data.vectors[neigh].deleted {
+					if !seen[neigh] {
+						seen[neigh] = true
+						candidates = append(candidates, neigh)
+					}
+					continue
+				}
+				for _, next := range pointer.graph[neigh][lc] {
+					if !seen[next] && !pointer.data.vectors[next].deleted {
+						seen[next] = true
+						candidates = append(candidates, next)
+					}
+				}
+			}
+			// 修复时不扩充候选集，候选点的邻居中仍可能有墓碑
+			if pointer.heuristic {
+				pointer.graph[i][lc] = pointer.selectNeighHeuristic(e, candidates, pointer.maxNeigh(lc), lc, false)
+			} else {
+				pointer.graph[i][lc] = pointer.selectNeighSimple(e, candidates, pointer.maxNeigh(lc))
+			}
 		}
 	}
+	// 移除墓碑，重新编号
+	newIndex := make([]int, pointer.data.length)
+	data := hnswVectors{vectors: make([]hnswVector, 0, pointer.data.length-pointer.deleted)}
+	vectors := NewFloatMatrix(0, pointer.vectors.dim)
+	for i, vector := range pointer.data.vectors {
+		if vector.deleted {
+			newIndex[i] = -1
+			continue
+		}
+		newIndex[i] = data.length
+		vector.index = data.length
+		data.Append(vector)
+		vectors.appendRow(pointer.vectors.row(i))
+	}
+	graph := make([][][]int, data.length)
+	locks := make([]*sync.Mutex, data.length)
+	for i := range locks {
+		locks[i] = new(sync.Mutex)
+	}
+	for i, layers := range pointer.graph {
+		if newIndex[i] < 0 {
+			continue
+		}
+		for lc, neighbors := range layers {
+			// 指向墓碑的邻居无法映射，直接丢弃
+			remapped := neighbors[:0]
+			for _, neigh := range neighbors {
+				if newIndex[neigh] >= 0 {
+					remapped = append(remapped, newIndex[neigh])
+				}
+			}
+			layers[lc] = remapped
+		}
+		graph[newIndex[i]] = layers
+	}
+	pointer.data, pointer.vectors, pointer.graph, pointer.locks, pointer.deleted = data, vectors, graph, locks, 0
+	for id, index := range pointer.ids {
+		pointer.ids[id] = newIndex[index]
+	}
+	// 重新选取入口点，尚未连接的结点没有邻居，只有所有结点都未连接时才选用
+	pointer.L = 0
+	pointer.ep = hnswVector{}
+	chosen := false
+	for _, vector := range pointer.data.vectors {
+		if pointer.pending[vector.id] {
+			continue
+		}
+		if !chosen || vector.layer > pointer.L {
+			pointer.L = vector.layer
+			pointer.ep = vector
+			chosen = true
+		}
+	}
+	if !chosen && pointer.data.length > 0 {
+		pointer.ep = pointer.data.vectors[0]
+		pointer.L = pointer.ep.layer
+	}
+}
+
+// 把已分配的结点连接到图中，调用者需持有mu的读锁
+func(pointer *Hnsw) connect(index int) {
+	q := pointer.data.vectors[index]
+	query := pointer.vectors.row(index)
+	pointer.epMu.Lock()
+	ep, L := pointer.ep, pointer.L
+	// 新点层级更高时会成为新的入口点，插入完成前一直持有入口锁，避免多个点同时替换入口
+	higher := q.layer > L
+	if !higher {
+		pointer.epMu.Unlock()
+	}
+	// 在高于layer的层中贪心下降，只找最近的一个点作为下一层入口
+	for lc := L; lc > q.layer; lc-- {
+		W := pointer.searchLayer(query, []int{ep.index}, 1, lc, nil)
+		if len(W) > 0 {
+			ep = pointer.data.vectors[W[0]]
+		}
+	}
+	eps := []int{ep.index}
+	for lc := minInt(q.layer, L); lc >= 0; lc-- {
+		W := pointer.searchLayer(query, eps, pointer.ef, lc, nil)
+		neighbors := pointer.selectNeigh(q, W, pointer.M, lc)
+		for _, e := range neighbors {
+			pointer.link(pointer.data.vectors[e], q, lc)
+		}
+		for _, e := range neighbors {
+			pointer.prune(pointer.data.vectors[e], lc)
+		}
+		if len(W) > 0 {
+			eps = W
+		}
+	}
+	if higher {
+		pointer.L = q.layer
+		pointer.ep = q
+		pointer.epMu.Unlock()
+	}
+}
+
+// 该层每个结点允许的最大邻居数，第0层为2*M
+func(pointer *Hnsw) maxNeigh(lc int) int {
+	if lc == 0 {
+		return 2 * pointer.M
+	}
+	return pointer.M
+}
+
+// 按索引的度量求向量q与表头编号为index的向量的得分，越大越近
+func(pointer *Hnsw) getDistance(q []float32, index int) float64 {
+	return pointer.metric.score32(q, pointer.vectors.row(index))
+}
+
+// 返回结点index在第lc层邻接表的副本
+func(pointer *Hnsw) getNeighbors(index int, lc int) []int {
+	lock := pointer.locks[index]
+	lock.Lock()
+	defer lock.Unlock()
+	return append([]int(nil), pointer.graph[index][lc]...)
 }
 
 // 在某一层连接两个点
 func(pointer *Hnsw) link(e hnswVector, q hnswVector, i int){
-
+	pointer.locks[e.index].Lock()
+	pointer.graph[e.index][i] = append(pointer.graph[e.index][i], q.index)
+	pointer.locks[e.index].Unlock()
+	pointer.locks[q.index].Lock()
+	pointer.graph[q.index][i] = append(pointer.graph[q.index][i], e.index)
+	pointer.locks[q.index].Unlock()
 }
 
 // 修剪某一层的点
+// 持有结点锁时不能再读取其他结点的邻接表，因此修剪时不扩充候选集
 func(pointer *Hnsw) prune(e hnswVector, i int){
+	maxNeigh := pointer.maxNeigh(i)
+	lock := pointer.locks[e.index]
+	lock.Lock()
+	defer lock.Unlock()
+	if len(pointer.graph[e.index][i]) <= maxNeigh {
+		return
+	}
+	if pointer.heuristic {
+		pointer.graph[e.index][i] = pointer.selectNeighHeuristic(e, pointer.graph[e.index][i], maxNeigh, i, false)
+	} else {
+		pointer.graph[e.index][i] = pointer.selectNeighSimple(e, pointer.graph[e.index][i], maxNeigh)
+	}
+}
 
+// 结点index是否不能作为结果返回：已删除或不满足过滤条件，filter为nil表示不过滤
+func(pointer *Hnsw) excluded(index int, filter func(id int) bool) bool {
+	vector := pointer.data.vectors[index]
+	return vector.deleted || (filter != nil && !filter(vector.id))
 }
 
-// 在指定层查询K个最近邻节点。q表示待插入向量，ep表示该层起始节点,lc表示所在层级 
-func(pointer *Hnsw) searchLayer(q hnswVector, ep hnswVector, lc int) (W []int){
+// 在指定层查询ef个最近邻节点。q表示待插入或查询的向量，ep表示该层起始节点,lc表示所在层级,filter为外部编号的过滤条件
+// 已删除或不满足过滤条件的结点可以被经过但不会出现在W中，返回的W按距离由近到远排列
+func(pointer *Hnsw) searchLayer(q []float32, ep []int, ef int, lc int, filter func(id int) bool) (W []int){
 	// v表示已访问点集, c 表示候选点集, w表示最近邻点集
-	v := make([]int, 0)
-	C := make([]int, 0)
-	W = make([]int ,0)
-	v, C , W = append(v, ep.index), append(C, ep.index), append(W, ep.index)
-	
+	v := make(map[int]bool)
+	C := &resultHeap{nearest: true}
+	nearest := &resultHeap{nearest: false}
+	for _, index := range ep {
+		v[index] = true
+		distance := pointer.getDistance(q, index)
+		heap.Push(C, searchResult{index: index, distance: distance})
+		if !pointer.excluded(index, filter) {
+			heap.Push(nearest, searchResult{index: index, distance: distance})
+		}
+	}
+	for nearest.Len() > ef {
+		heap.Pop(nearest)
+	}
+	for C.Len() > 0 {
+		c := heap.Pop(C).(searchResult)
+		// W未满时继续扩展，避免入口附近的墓碑导致结果不足
+		if nearest.Len() >= ef && c.distance < nearest.top().distance {
+			break
+		}
+		for _, e := range pointer.getNeighbors(c.index, lc) {
+			if v[e] {
+				continue
+			}
+			v[e] = true
+			distance := pointer.getDistance(q, e)
+			if nearest.Len() < ef || distance > nearest.top().distance {
+				heap.Push(C, searchResult{index: e, distance: distance})
+				if pointer.excluded(e, filter) {
+					continue
+				}
+				heap.Push(nearest, searchResult{index: e, distance: distance})
+				if nearest.Len() > ef {
+					heap.Pop(nearest)
+				}
+			}
+		}
+	}
+	W = make([]int, nearest.Len())
+	for i := len(W) - 1; i >= 0; i-- {
+		W[i] = heap.Pop(nearest).(searchResult).index
+	}
 	return
 }
 
-// 选取出节点q在候选集C中的M个最近邻居
-func(pointer *Hnsw) selectNeigh(q hnswVector, C [] int, M int) (W hnswVectors){
+// 选取出节点q在候选集C中的M个邻居，lc表示所在层级
+func(pointer *Hnsw) selectNeigh(q hnswVector, C []int, M int, lc int) (W []int){
+	if pointer.heuristic {
+		return pointer.selectNeighHeuristic(q, C, M, lc, pointer.extendCandidates)
+	}
+	return pointer.selectNeighSimple(q, C, M)
+}
+
+// 计算候选集C中每个点与q的距离，并按由近到远排列，会略过q本身
+func(pointer *Hnsw) sortCandidates(q hnswVector, C []int) []searchResult {
+	query := pointer.vectors.row(q.index)
+	candidates := make([]searchResult, 0, len(C))
+	for _, index := range C {
+		if index == q.index {
+			continue
+		}
+		candidates = append(candidates, searchResult{index: index, distance: pointer.getDistance(query, index)})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].distance > candidates[j].distance
+	})
+	return candidates
+}
+
+// 简单选邻居：直接取最近的M个
+func(pointer *Hnsw) selectNeighSimple(q hnswVector, C []int, M int) (W []int){
+	candidates := pointer.sortCandidates(q, C)
+	if len(candidates) > M {
+		candidates = candidates[:M]
+	}
+	W = make([]int, len(candidates))
+	for i, candidate := range candidates {
+		W[i] = candidate.index
+	}
 	return
 }
 
+// 启发式选邻居：候选点只有在离q比离所有已选邻居都近时才被选中，以保持不同簇之间的连通性
+// extend表示是否用候选点的邻居扩充候选集
+func(pointer *Hnsw) selectNeighHeuristic(q hnswVector, C []int, M int, lc int, extend bool) (W []int){
+	if extend {
+		// C可能是邻接表本身，先复制一份再扩充
+		C = append([]int(nil), C...)
+		extended := make(map[int]bool, len(C))
+		for _, index := range C {
+			extended[index] = true
+		}
+		for _, index := range C {
+			for _, neigh := range pointer.getNeighbors(index, lc) {
+				if !extended[neigh] {
+					extended[neigh] = true
+					C = append(C, neigh)
+				}
+			}
+		}
+	}
+	candidates := pointer.sortCandidates(q, C)
+	W = make([]int, 0, M)
+	// discarded 表示被舍弃的点，仍按由近到远排列
+	discarded := make([]int, 0)
+	for _, candidate := range candidates {
+		if len(W) >= M {
+			break
+		}
+		e := pointer.vectors.row(candidate.index)
+		good := true
+		for _, r := range W {
+			if pointer.getDistance(e, r) > candidate.distance {
+				good = false
+				break
+			}
+		}
+		if good {
+			W = append(W, candidate.index)
+		} else {
+			discarded = append(discarded, candidate.index)
+		}
+	}
+	if pointer.keepPrunedConnections {
+		for _, index := range discarded {
+			if len(W) >= M {
+				break
+			}
+			W = append(W, index)
+		}
+	}
+	return
+}
+
+
+// 存储索引 path为索引文件路径
+// 文件格式：魔数与版本号，M/ef/L/ml/入口点/选邻居选项/距离度量，降维标记与降维变换，结点数与维度，
+// 随后依次为每个结点的层级、外部编号、删除标记、float32向量以及每一层的邻接表，
+// 最后为已分配但尚未连接的结点个数与外部编号，加载时再把它们连接到图中
+func(pointer *Hnsw) storeIndex(path string) error {
+	// 持写锁以得到一致的快照
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	outputFile, outputError := os.Create(path)
+	if outputError != nil {
+		return outputError
+	}
+	defer outputFile.Close()
+	writer := bufio.NewWriter(outputFile)
+	dim := 0
+	if pointer.data.length > 0 {
+		dim = pointer.vectors.dim
+	}
+	header := []interface{}{
+		[]byte(hnswMagic), uint32(hnswVersion),
+		int64(pointer.M), int64(pointer.ef), int64(pointer.L), pointer.ml, int64(pointer.ep.index),
+		pointer.heuristic, pointer.extendCandidates, pointer.keepPrunedConnections, int64(pointer.metric),
+		pointer.pca.trained(),
+	}
+	for _, field := range header {
+		if err := binary.Write(writer, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	if pointer.pca.trained() {
+		if err := pointer.pca.writeTo(writer); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(writer, binary.LittleEndian, []int64{int64(pointer.data.length), int64(dim)}); err != nil {
+		return err
+	}
+	for i, vector := range pointer.data.vectors {
+		if err := binary.Write(writer, binary.LittleEndian, []int64{int64(vector.layer), int64(vector.id)}); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, vector.deleted); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, pointer.vectors.row(i)); err != nil {
+			return err
+		}
+		for _, neighbors := range pointer.graph[i] {
+			if err := binary.Write(writer, binary.LittleEndian, int64(len(neighbors))); err != nil {
+				return err
+			}
+			for _, neigh := range neighbors {
+				if err := binary.Write(writer, binary.LittleEndian, int64(neigh)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// 持写锁时正在连接的结点都已连接完毕，pending中只剩尚未开始连接的结点
+	pending := make([]int64, 0, len(pointer.pending))
+	for id := range pointer.pending {
+		pending = append(pending, int64(id))
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i] < pending[j]
+	})
+	if err := binary.Write(writer, binary.LittleEndian, int64(len(pending))); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.LittleEndian, pending); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
 
-// 存储索引
-func(pointer *Hnsw) storeIndex() {
+// 加载索引 path为storeIndex生成的索引文件路径，加载后可直接调用searchVector查询
+func(pointer *Hnsw) loadIndex(path string) error {
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	inputFile, inputError := os.Open(path)
+	if inputError != nil {
+		return inputError
+	}
+	defer inputFile.Close()
+	// 文件中读出的个数都不能超过文件大小所能容纳的个数，避免损坏的文件导致巨大的分配
+	info, err := inputFile.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	corrupt := errors.New("hnsw索引文件已损坏")
+	reader := bufio.NewReader(inputFile)
+	magic := make([]byte, len(hnswMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != hnswMagic {
+		return errors.New("不是hnsw索引文件")
+	}
+	var version uint32
+	if err := binary.Read(reader, binary.LittleEndian, &version); err != nil {
+		return err
+	}
+	if version != hnswVersion {
+		return fmt.Errorf("hnsw索引文件版本为%d, 当前只支持版本%d, 请重新建立索引", version, hnswVersion)
+	}
+	var M, ef, L, ep, metric, length, dim int64
+	var ml float64
+	var heuristic, extendCandidates, keepPrunedConnections, hasPCA bool
+	header := []interface{}{&M, &ef, &L, &ml, &ep, &heuristic, &extendCandidates, &keepPrunedConnections, &metric, &hasPCA}
+	for _, field := range header {
+		if err := binary.Read(reader, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	if M <= 0 || ef < 0 || L < 0 {
+		return corrupt
+	}
+	var pca *PCA
+	if hasPCA {
+		pca = &PCA{}
+		if err := pca.readFrom(reader); err != nil {
+			return err
+		}
+	}
+	for _, field := range []interface{}{&length, &dim} {
+		if err := binary.Read(reader, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	// 每个结点至少有层级、编号、删除标记、向量与第0层的邻居个数
+	if length < 0 || dim < 0 || dim > size/4 || (length > 0 && dim == 0) || length > size/(25+4*dim) {
+		return corrupt
+	}
+	data := hnswVectors{vectors: make([]hnswVector, 0, length)}
+	vectors := NewFloatMatrix(int(length), int(dim))
+	graph := make([][][]int, length)
+	ids := make(map[int]int, length)
+	deletedCount, nextID := 0, 0
+	for i := 0; i < int(length); i++ {
+		var layer, id int64
+		if err := binary.Read(reader, binary.LittleEndian, &layer); err != nil {
+			return err
+		}
+		if layer < 0 || layer > size/8 {
+			return corrupt
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &id); err != nil {
+			return err
+		}
+		var deleted bool
+		if err := binary.Read(reader, binary.LittleEndian, &deleted); err != nil {
+			return err
+		}
+		if err := binary.Read(reader, binary.LittleEndian, vectors.row(i)); err != nil {
+			return err
+		}
+		q := NewHnswVector(int(layer), i)
+		q.id, q.deleted = int(id), deleted
+		data.Append(*q)
+		if q.id >= nextID {
+			nextID = q.id + 1
+		}
+		if deleted {
+			deletedCount++
+		} else {
+			ids[q.id] = i
+		}
+		graph[i] = make([][]int, layer+1)
+		for lc := range graph[i] {
+			var count int64
+			if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+				return err
+			}
+			if count < 0 || count > length {
+				return corrupt
+			}
+			neighbors := make([]int64, count)
+			if err := binary.Read(reader, binary.LittleEndian, neighbors); err != nil {
+				return err
+			}
+			graph[i][lc] = make([]int, count)
+			for j, neigh := range neighbors {
+				if neigh < 0 || neigh >= length {
+					return corrupt
+				}
+				graph[i][lc][j] = int(neigh)
+			}
+		}
+	}
+	var pendingCount int64
+	if err := binary.Read(reader, binary.LittleEndian, &pendingCount); err != nil {
+		return err
+	}
+	if pendingCount < 0 || pendingCount > length {
+		return corrupt
+	}
+	pending := make([]int64, pendingCount)
+	if err := binary.Read(reader, binary.LittleEndian, pending); err != nil {
+		return err
+	}
+	for _, id := range pending {
+		if _, ok := ids[int(id)]; !ok {
+			return corrupt
+		}
+	}
+	// 每个邻居在该层都要存在，入口点的层级不能低于最高层
+	for _, layers := range graph {
+		for lc, neighbors := range layers {
+			for _, neigh := range neighbors {
+				if len(graph[neigh]) <= lc {
+					return corrupt
+				}
+			}
+		}
+	}
+	if length > 0 && (ep < 0 || ep >= length || int64(data.vectors[ep].layer) < L) {
+		return corrupt
+	}
+	pointer.M, pointer.ef, pointer.L, pointer.ml = int(M), int(ef), int(L), ml
+	pointer.heuristic, pointer.extendCandidates, pointer.keepPrunedConnections = heuristic, extendCandidates, keepPrunedConnections
+	pointer.metric = Metric(metric)
+	pointer.pca = pca
+	locks := make([]*sync.Mutex, length)
+	for i := range locks {
+		locks[i] = new(sync.Mutex)
+	}
+	pointer.data, pointer.vectors, pointer.graph, pointer.ids, pointer.deleted = data, vectors, graph, ids, deletedCount
+	pointer.locks, pointer.nextID, pointer.pending = locks, nextID, make(map[int]bool)
+	if length > 0 {
+		pointer.ep = data.vectors[ep]
+	}
+	// 保存时尚未连接的结点按编号顺序连接，持写锁满足connect对读锁的要求
+	for _, id := range pending {
+		pointer.connect(ids[int(id)])
+	}
+	return nil
+}
 
+// 查找与输入向量最接近的k个向量，efSearch为查询时的动态表大小，越大召回越高、耗时越长
+// 返回结果的index为向量的外部编号，按距离由近到远排列；k不大于0或查询维度与索引不符时返回nil
+func(pointer *Hnsw) searchVector(inputVector floatVector, k int, efSearch int) []searchResult {
+	return pointer.searchVectorFilter(inputVector, k, efSearch, nil)
 }
 
-// 加载索引并进行查找
-func(pointer *Hnsw) searchVector(){
+// 只在编号属于allow的向量中查找最接近的k个向量
+func(pointer *Hnsw) searchVectorAllow(inputVector floatVector, k int, efSearch int, allow bitset) []searchResult {
+	return pointer.searchVectorFilter(inputVector, k, efSearch, allow.contains)
+}
 
+// 只在满足filter的向量中查找最接近的k个向量，filter的参数为向量的外部编号
+// 不满足条件的结点仍会被经过但不会返回；过滤条件越严格，动态表自动放得越大，
+// 结果不足k个时继续加倍，直到覆盖整个图
+func(pointer *Hnsw) searchVectorFilter(inputVector floatVector, k int, efSearch int, filter func(id int) bool) []searchResult {
+	if k <= 0 {
+		return nil
+	}
+	inputVector, err := pointer.pca.applyVector(inputVector)
+	if err != nil {
+		fmt.Print(err)
+		return nil
+	}
+	pointer.mu.RLock()
+	defer pointer.mu.RUnlock()
+	if pointer.data.length == 0 {
+		return nil
+	}
+	if len(inputVector.vector) != pointer.vectors.dim {
+		fmt.Print("输入特征维度与索引维度不匹配")
+		return nil
+	}
+	if efSearch < k {
+		efSearch = k
+	}
+	if filter != nil {
+		selectivity := pointer.filterSelectivity(filter)
+		efSearch = minInt(int(float64(efSearch)/selectivity), pointer.data.length)
+	}
+	q := toFloat32(inputVector.vector)
+	pointer.epMu.Lock()
+	ep, L := pointer.ep, pointer.L
+	pointer.epMu.Unlock()
+	// 从入口点逐层贪心下降到第0层
+	for lc := L; lc > 0; lc-- {
+		W := pointer.searchLayer(q, []int{ep.index}, 1, lc, nil)
+		if len(W) > 0 {
+			ep = pointer.data.vectors[W[0]]
+		}
+	}
+	W := pointer.searchLayer(q, []int{ep.index}, efSearch, 0, filter)
+	for len(W) < k && efSearch < pointer.data.length {
+		efSearch = minInt(efSearch*2, pointer.data.length)
+		W = pointer.searchLayer(q, []int{ep.index}, efSearch, 0, filter)
+	}
+	if len(W) > k {
+		W = W[:k]
+	}
+	result := make([]searchResult, len(W))
+	for i, index := range W {
+		result[i] = searchResult{index: pointer.data.vectors[index].id, distance: pointer.getDistance(q, index)}
+	}
+	return result
 }
 
+// 估计满足filter的结点比例，最多均匀抽查hnswFilterSample个结点
+func(pointer *Hnsw) filterSelectivity(filter func(id int) bool) float64 {
+	step := pointer.data.length/hnswFilterSample + 1
+	total, passed := 0, 0
+	for i := 0; i < pointer.data.length; i += step {
+		total++
+		if !pointer.excluded(i, filter) {
+			passed++
+		}
+	}
+	if passed == 0 {
+		return 1 / float64(pointer.data.length)
+	}
+	return float64(passed) / float64(total)
+}
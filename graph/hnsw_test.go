@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// 生成n个dim维的随机向量
+func randomVectors(n int, dim int, seed int64) []floatVector {
+	random := rand.New(rand.NewSource(seed))
+	result := make([]floatVector, n)
+	for i := range result {
+		values := make([]float64, dim)
+		for j := range values {
+			values[j] = random.NormFloat64()
+		}
+		vector := NewFloatVector(dim)
+		vector.SetVector(values)
+		result[i] = *vector
+	}
+	return result
+}
+
+// 把向量写成不带编号的csv数据文件
+func writeVectorsCsv(t *testing.T, path string, vectors []floatVector) {
+	outputFile, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outputFile.Close()
+	outputWriter := csv.NewWriter(outputFile)
+	for _, vector := range vectors {
+		row := make([]string, len(vector.vector))
+		for j, value := range vector.vector {
+			row[j] = strconv.FormatFloat(value, 'f', -1, 64)
+		}
+		outputWriter.Write(row)
+	}
+	outputWriter.Flush()
+	if err := outputWriter.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 检查图中每个邻居都指向存活的结点
+func checkHnswGraph(t *testing.T, hnsw *Hnsw) {
+	for i, layers := range hnsw.graph {
+		for lc, neighbors := range layers {
+			for _, neigh := range neighbors {
+				if neigh < 0 || neigh >= hnsw.data.length {
+					t.Fatalf("结点%d第%d层的邻居%d越界", i, lc, neigh)
+				}
+				if hnsw.data.vectors[neigh].deleted {
+					t.Fatalf("结点%d第%d层的邻居%d已删除", i, lc, neigh)
+				}
+			}
+		}
+	}
+}
+
+// 启发式选邻居并扩充候选集时，删除一半结点后压缩，图中不应留下墓碑或无效编号，查询只返回存活的向量
+func TestHnswCompactHeuristic(t *testing.T) {
+	vectors := randomVectors(500, 8, 1)
+	hnsw := NewHnsw(4, 32)
+	hnsw.setSeed(1)
+	hnsw.setMetric(L2)
+	hnsw.useHeuristic(true, true)
+	for i, vector := range vectors {
+		if err := hnsw.Add(i, vector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < len(vectors); i += 2 {
+		if err := hnsw.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hnsw.Compact()
+	if hnsw.data.length != 250 || len(hnsw.ids) != 250 {
+		t.Fatalf("压缩后应有250个结点, 实际%d个", hnsw.data.length)
+	}
+	checkHnswGraph(t, hnsw)
+	found := 0
+	for i := 0; i < len(vectors); i += 10 {
+		result := hnsw.searchVector(vectors[i], 5, 64)
+		if len(result) == 0 {
+			t.Fatalf("查询%d没有结果", i)
+		}
+		for _, item := range result {
+			if item.index%2 == 1 {
+				t.Fatalf("查询%d返回了已删除的向量%d", i, item.index)
+			}
+		}
+		if result[0].index == i {
+			found++
+		}
+	}
+	if found < 45 {
+		t.Fatalf("50次查询只有%d次找到自身", found)
+	}
+}
+
+// 删除并压缩后再次createIndex，新向量的编号不能与已有编号冲突
+func TestHnswCreateIndexAfterCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0.csv")
+	writeVectorsCsv(t, path, randomVectors(5, 4, 2))
+	hnsw := NewHnsw(4, 16)
+	hnsw.setSeed(2)
+	hnsw.createIndex(path, 4)
+	if err := hnsw.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	hnsw.Compact()
+	hnsw.createIndex(path, 4)
+	if len(hnsw.ids) != 9 {
+		t.Fatalf("应有9个向量, 实际%d个", len(hnsw.ids))
+	}
+	for id := 5; id < 10; id++ {
+		if _, ok := hnsw.ids[id]; !ok {
+			t.Fatalf("第二次载入的向量缺少编号%d", id)
+		}
+	}
+}
+
+// 保存后载入到零值的Hnsw，查询结果与原索引相同，编号分配也延续下去
+func TestHnswStoreLoad(t *testing.T) {
+	vectors := randomVectors(200, 8, 3)
+	hnsw := NewHnsw(6, 32)
+	hnsw.setSeed(3)
+	hnsw.useHeuristic(false, true)
+	for i, vector := range vectors {
+		if err := hnsw.Add(i, vector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < len(vectors); i += 3 {
+		hnsw.Delete(i)
+	}
+	path := filepath.Join(t.TempDir(), "hnsw.bin")
+	if err := hnsw.storeIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Hnsw{}
+	if err := loaded.loadIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.data.length != hnsw.data.length || loaded.deleted != hnsw.deleted || loaded.nextID != hnsw.nextID {
+		t.Fatalf("载入的结点数%d、墓碑数%d或下一个编号%d与原索引不同", loaded.data.length, loaded.deleted, loaded.nextID)
+	}
+	for i := 1; i < len(vectors); i += 7 {
+		want := hnsw.searchVector(vectors[i], 5, 32)
+		got := loaded.searchVector(vectors[i], 5, 32)
+		if len(want) != len(got) {
+			t.Fatalf("查询%d的结果个数不同", i)
+		}
+		for j := range want {
+			if want[j] != got[j] {
+				t.Fatalf("查询%d的第%d个结果不同: %v, %v", i, j, want[j], got[j])
+			}
+		}
+	}
+	loaded.Compact()
+	checkHnswGraph(t, loaded)
+	if err := loaded.Add(len(vectors), vectors[0]); err != nil {
+		t.Fatal(err)
+	}
+	if result := loaded.searchVector(vectors[0], 1, 32); len(result) == 0 || result[0].index != len(vectors) {
+		t.Fatalf("载入并压缩后插入的向量查不到: %v", result)
+	}
+}
+
+// 批量插入的同时删除、压缩与查询，结束后图中只有存活结点且所有插入的向量都可查到
+func TestHnswConcurrentCompact(t *testing.T) {
+	vectors := randomVectors(2000, 8, 4)
+	hnsw := NewHnsw(4, 32)
+	hnsw.setSeed(4)
+	hnsw.setMetric(L2)
+	hnsw.useHeuristic(true, false)
+	ids := make([]int, len(vectors))
+	for i := range ids {
+		ids[i] = i
+	}
+	done := make(chan error)
+	go func() {
+		done <- hnsw.AddBatch(ids, vectors)
+	}()
+	deleted := make(map[int]bool)
+	for i := 0; i < len(vectors); i += 97 {
+		if hnsw.Delete(i) == nil {
+			deleted[i] = true
+		}
+		hnsw.Compact()
+		hnsw.searchVector(vectors[i], 3, 16)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	hnsw.Compact()
+	checkHnswGraph(t, hnsw)
+	if len(hnsw.pending) != 0 {
+		t.Fatalf("插入结束后仍有%d个结点未连接", len(hnsw.pending))
+	}
+	for i := 1; i < len(vectors); i += 37 {
+		if deleted[i] {
+			continue
+		}
+		if result := hnsw.searchVector(vectors[i], 1, 64); len(result) == 0 || result[0].index != i {
+			t.Fatalf("插入的向量%d查不到: %v", i, result)
+		}
+	}
+}
+
+// k不大于0或查询维度与索引不符时返回nil而不是崩溃
+func TestHnswSearchInvalid(t *testing.T) {
+	hnsw := NewHnsw(4, 16)
+	hnsw.setSeed(7)
+	for i, vector := range randomVectors(20, 4, 7) {
+		hnsw.Add(i, vector)
+	}
+	query := randomVectors(1, 4, 8)[0]
+	if result := hnsw.searchVector(query, 0, 0); result != nil {
+		t.Fatalf("k为0时应返回nil: %v", result)
+	}
+	for _, dim := range []int{2, 8} {
+		if result := hnsw.searchVector(randomVectors(1, dim, 9)[0], 3, 16); result != nil {
+			t.Fatalf("%d维查询应返回nil: %v", dim, result)
+		}
+	}
+}
+
+// 损坏的索引文件返回错误而不是崩溃或巨大的分配：结点数为负或过大，邻居在该层不存在
+func TestHnswLoadCorrupt(t *testing.T) {
+	hnsw := NewHnsw(2, 16)
+	hnsw.setSeed(10)
+	for i, vector := range randomVectors(50, 4, 10) {
+		hnsw.Add(i, vector)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hnsw.bin")
+	if err := hnsw.storeIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 结点数位于魔数、版本号与定长参数之后
+	const lengthOffset = 60
+	if binary.LittleEndian.Uint64(content[lengthOffset:]) != 50 {
+		t.Fatal("结点数的位置与文件格式不符")
+	}
+	for _, length := range []int64{-1, 1 << 40} {
+		broken := append([]byte(nil), content...)
+		binary.LittleEndian.PutUint64(broken[lengthOffset:], uint64(length))
+		brokenPath := filepath.Join(dir, "broken.bin")
+		if err := ioutil.WriteFile(brokenPath, broken, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := (&Hnsw{}).loadIndex(brokenPath); err == nil {
+			t.Fatalf("结点数为%d时应返回错误", length)
+		}
+	}
+	// 在高层的邻接表中加入一个只在第0层的结点
+	high, low := -1, -1
+	for i, vector := range hnsw.data.vectors {
+		if vector.layer > 0 && high < 0 {
+			high = i
+		}
+		if vector.layer == 0 && low < 0 {
+			low = i
+		}
+	}
+	if high < 0 || low < 0 {
+		t.Fatal("没有同时存在高层与只在第0层的结点")
+	}
+	hnsw.graph[high][1] = append(hnsw.graph[high][1], low)
+	if err := hnsw.storeIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Hnsw{}).loadIndex(path); err == nil {
+		t.Fatal("邻居在该层不存在时应返回错误")
+	}
+}
+
+// 已分配但尚未连接的结点随索引保存，加载后连接到图中，仍可查到
+func TestHnswStorePending(t *testing.T) {
+	vectors := randomVectors(300, 8, 11)
+	hnsw := NewHnsw(4, 32)
+	hnsw.setSeed(11)
+	hnsw.setMetric(L2)
+	for i := 0; i < 100; i++ {
+		hnsw.Add(i, vectors[i])
+	}
+	// 模拟批量插入进行到一半时保存：只分配结点，不连接
+	ids := make([]int, 0, 200)
+	for i := 100; i < len(vectors); i++ {
+		ids = append(ids, i)
+	}
+	rows, err := vectorsToMatrix(vectors[100:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hnsw.reserve(ids, rows); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "hnsw.bin")
+	if err := hnsw.storeIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Hnsw{}
+	if err := loaded.loadIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.pending) != 0 {
+		t.Fatalf("加载后仍有%d个结点未连接", len(loaded.pending))
+	}
+	found := 0
+	for i := 100; i < len(vectors); i++ {
+		if result := loaded.searchVector(vectors[i], 1, 64); len(result) > 0 && result[0].index == i {
+			found++
+		}
+	}
+	if found < 190 {
+		t.Fatalf("200个保存时未连接的向量只有%d个查到自身", found)
+	}
+}
+
+// 降维变换未训练时Add返回错误，经AddBatch训练后可以逐个插入
+func TestHnswAddBeforePCA(t *testing.T) {
+	vectors := randomVectors(100, 8, 12)
+	hnsw := NewHnsw(4, 16)
+	hnsw.setSeed(12)
+	hnsw.setMetric(L2)
+	hnsw.usePCA(NewPCA(4, false))
+	if err := hnsw.Add(0, vectors[0]); err == nil {
+		t.Fatal("降维变换未训练时Add应返回错误")
+	}
+	if len(hnsw.ids) != 0 {
+		t.Fatalf("Add失败后不应留下结点, 实际%d个", len(hnsw.ids))
+	}
+	ids := make([]int, 99)
+	for i := range ids {
+		ids[i] = i
+	}
+	if err := hnsw.AddBatch(ids, vectors[:99]); err != nil {
+		t.Fatal(err)
+	}
+	if err := hnsw.Add(99, vectors[99]); err != nil {
+		t.Fatal(err)
+	}
+	if result := hnsw.searchVector(vectors[99], 1, 32); len(result) == 0 || result[0].index != 99 {
+		t.Fatalf("训练后插入的向量查不到: %v", result)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ingestPolicy 严格载入时对一类数据问题的处理方式
+type ingestPolicy int
+
+const (
+	// IngestFail 遇到问题立即返回错误，为默认的处理方式
+	IngestFail ingestPolicy = iota
+	// IngestSkip 跳过有问题的行，文件载入结束时打印跳过的行数
+	IngestSkip
+	// IngestLog 打印问题所在的位置，该行仍按宽松规则载入
+	IngestLog
+)
+
+// ingestProblem 载入数据时可能遇到的问题
+type ingestProblem int
+
+const (
+	// ProblemMalformed 无法解析的数值或编号，以及csv格式错误
+	ProblemMalformed ingestProblem = iota
+	// ProblemDimension 列数与向量维度不符
+	ProblemDimension
+	// ProblemNonFinite 取值为NaN或无穷大
+	ProblemNonFinite
+	// ProblemZeroNorm 模为0的向量
+	ProblemZeroNorm
+	ingestProblemCount
+)
+
+// 返回问题的名称
+func (problem ingestProblem) String() string {
+	switch problem {
+	case ProblemMalformed:
+		return "格式错误"
+	case ProblemDimension:
+		return "维度错误"
+	case ProblemNonFinite:
+		return "非有限值"
+	case ProblemZeroNorm:
+		return "零向量"
+	}
+	return fmt.Sprintf("ingestProblem(%d)", int(problem))
+}
+
+// ingestError 载入数据时发现的一个问题，line与column从1开始，column为0表示整行的问题
+type ingestError struct {
+	path    string
+	line    int
+	column  int
+	problem ingestProblem
+	message string
+}
+
+func (pointer *ingestError) Error() string {
+	if pointer.column > 0 {
+		return fmt.Sprintf("%s第%d行第%d列%s: %s", pointer.path, pointer.line, pointer.column, pointer.problem, pointer.message)
+	}
+	return fmt.Sprintf("%s第%d行%s: %s", pointer.path, pointer.line, pointer.problem, pointer.message)
+}
+
+// ingestOptions 严格载入的设置，policies为每类问题的处理方式
+// 索引不设置时为nil，表示宽松载入：无法解析的单元格为0，过短的行补0，与之前的行为一致
+type ingestOptions struct {
+	policies [ingestProblemCount]ingestPolicy
+}
+
+// NewIngestOptions 向外生产一个严格载入设置，所有问题都按policy处理
+func NewIngestOptions(policy ingestPolicy) *ingestOptions {
+	options := &ingestOptions{}
+	for i := range options.policies {
+		options.policies[i] = policy
+	}
+	return options
+}
+
+// 单独设置一类问题的处理方式
+func (pointer *ingestOptions) setPolicy(problem ingestProblem, policy ingestPolicy) {
+	pointer.policies[problem] = policy
+}
+
+// 按问题的处理方式处理一个问题，返回该行是否保留，处理方式为失败时返回错误
+func (pointer *ingestOptions) handle(problem *ingestError) (bool, error) {
+	switch pointer.policies[problem.problem] {
+	case IngestSkip:
+		return false, nil
+	case IngestLog:
+		fmt.Println(problem)
+		return true, nil
+	}
+	return false, problem
+}
+
+// 严格解析一行的编号，编号位于第一列
+func (pointer *ingestOptions) parseIndex(path string, line int, element string) (index int, keep bool, err error) {
+	index, parseError := strconv.Atoi(strings.TrimSpace(element))
+	if parseError == nil {
+		return index, true, nil
+	}
+	keep, err = pointer.handle(&ingestError{path: path, line: line, column: 1, problem: ProblemMalformed,
+		message: fmt.Sprintf("编号%q无法解析", element)})
+	return 0, keep, err
+}
+
+// 严格解析一行 data为向量的各列，offset为向量第一列之前的列数（第一列为编号时为1），用于报告列号
+// keep为false表示跳过该行，按日志处理的问题按宽松规则载入：无法解析的单元格为0，过短补0，过长截断
+func (pointer *ingestOptions) parseRow(path string, line int, offset int, data []string, length int) (vector []float64, keep bool, err error) {
+	if len(data) != length {
+		keep, err = pointer.handle(&ingestError{path: path, line: line, problem: ProblemDimension,
+			message: fmt.Sprintf("有%d列, 向量维度为%d", len(data), length)})
+		if !keep {
+			return nil, false, err
+		}
+		if len(data) > length {
+			data = data[:length]
+		}
+	}
+	vector = make([]float64, length)
+	var module float64
+	for i, element := range data {
+		value, parseError := strconv.ParseFloat(strings.TrimSpace(element), 64)
+		var problem *ingestError
+		// 超出范围时ParseFloat返回无穷大或0，无穷大按非有限值处理，下溢为0时照常载入
+		if parseError != nil && !errors.Is(parseError, strconv.ErrRange) {
+			value = 0
+			problem = &ingestError{problem: ProblemMalformed, message: fmt.Sprintf("%q无法解析为数值", element)}
+		} else if math.IsNaN(value) || math.IsInf(value, 0) {
+			problem = &ingestError{problem: ProblemNonFinite, message: fmt.Sprintf("%q不是有限值", element)}
+		}
+		if problem != nil {
+			problem.path, problem.line, problem.column = path, line, offset+i+1
+			keep, err = pointer.handle(problem)
+			if !keep {
+				return nil, false, err
+			}
+		}
+		vector[i] = value
+		module += value * value
+	}
+	if module == 0 {
+		keep, err = pointer.handle(&ingestError{path: path, line: line, problem: ProblemZeroNorm, message: "向量的模为0"})
+		if !keep {
+			return nil, false, err
+		}
+	}
+	return vector, true, nil
+}
@@ -8,11 +8,11 @@ import (
 	"io/ioutil"
 
 	//"log"
+	"math"
 	"math/rand"
 	"os"
 	"strconv"
 	"sync"
-	"time"
 )
 
 // IvfPQ 量化索引，用于生成量化表
@@ -20,30 +20,166 @@ type IvfPQ struct {
 	M          int             // M 为量化区段
 	pqRoot     string          // 量化表的储存位置
 	bucketRoot string          // bucketRoot 为桶位置
-	center     *floatVectors   // center为第一次聚类的聚心
-	pqCenter   []*floatVectors // pqCenter 为用于编码的聚类聚心共有M*pqNum个floatVector
+	center     *floatMatrix    // center为第一次聚类的聚心
+	pqCenter   []*floatMatrix  // pqCenter 为用于编码的聚类聚心，共M个pqNum行的矩阵
 	residual   bool
+	random     *rand.Rand      // random 为采样与训练使用的随机数生成器
+	quantizer  hnswQuantizer   // quantizer 为寻找最近桶使用的粗量化器
+	nprobe     int             // nprobe 为查找时搜索的桶个数
+	metric     Metric          // metric 为距离度量，决定粗聚类、查找表与排序方式
+	pca        *PCA            // pca 为放在索引之前的降维变换，为nil表示不降维
+	opqIterations int          // opqIterations 为学习OPQ旋转时交替的轮数，为0表示不使用OPQ
+	rotation   *floatMatrix    // rotation 为OPQ旋转矩阵，编码与生成查找表前先旋转，为nil表示不旋转
+	ingest     *ingestOptions  // ingest 为读取数据与桶文件的严格载入设置，为nil时宽松载入
+	coarseOptions kmeansOptions // coarseOptions 为粗聚类的训练设置
+	pqOptions  kmeansOptions   // pqOptions 为各段pq码本的训练设置
+	coarseReport *kmeansReport // coarseReport 为粗聚类的训练报告，使用已有的桶时为nil
+	pqReports  []*kmeansReport // pqReports 为各段pq码本的训练报告
+	batchSize  int             // batchSize 为粗聚类小批量模式的批大小，为0表示不使用小批量
+	epochs     int             // epochs 为粗聚类小批量模式的最大轮数
+	maxBucketSize int          // maxBucketSize 为分桶时每个桶的最大向量数，为0表示不限制
+	buckets    *bucketReport   // buckets 为分桶的桶大小报告，使用已有的桶时为nil
 }
 
-// NewIvfPQ 生成一个量化结构体
+// NewIvfPQ 生成一个量化结构体，默认以当前时间为随机种子
 func NewIvfPQ(M int, residual bool) *IvfPQ {
-	return &IvfPQ{M: M, residual: residual}
+	return &IvfPQ{M: M, residual: residual, random: newTimeRand()}
 }
 
+// 设置随机种子，种子相同且数据相同时建立的索引完全一致
+func (pointer *IvfPQ) setSeed(seed int64) {
+	pointer.random = newRand(seed)
+}
 
-// 为一个向量的每一块生成编号
-func (pointer *IvfPQ) getCode(clusterPoint *floatVectors, vector *floatVector, ch chan int) {
-	maxIndex, maxDistance := 0, -100000.0
-	for i, point := range clusterPoint.vectors {
-		distance, err := vector.distance(point, true)
-		if err != nil {
-			fmt.Print(err)
+// 在粗聚心上建立hnsw图作为粗量化器，用于分桶与查找，适用于桶很多的情况
+// M与ef为hnsw的建图参数，efSearch为查找时的动态表大小
+func (pointer *IvfPQ) useHnswQuantizer(M int, ef int, efSearch int) {
+	pointer.quantizer = hnswQuantizer{M: M, ef: ef, efSearch: efSearch}
+}
+
+// 设置距离度量，需在建立索引前设置，查找时也需使用相同的度量
+func (pointer *IvfPQ) setMetric(m Metric) {
+	pointer.metric = m
+}
+
+// 设置查找时搜索的桶个数
+func (pointer *IvfPQ) setNprobe(nprobe int) {
+	pointer.nprobe = nprobe
+}
+
+// 在索引之前加入降维变换，未训练时在粗聚类的采样点上训练，并随桶一起保存为bucket/pca.bin
+// 降维后的维度需能被M整除
+func (pointer *IvfPQ) usePCA(pca *PCA) {
+	pointer.pca = pca
+}
+
+// 使用OPQ：建立索引时与pq码本交替学习一个正交旋转，iterations为交替的轮数
+// 旋转矩阵保存为pqCode/rotation.csv，编码与查找时自动使用
+func (pointer *IvfPQ) useOPQ(iterations int) {
+	pointer.opqIterations = iterations
+}
+
+// 设置初始聚簇中心的选取方式，coarse用于粗聚类，pq用于各段pq码本，默认都为随机选取
+func (pointer *IvfPQ) setCenterInit(coarse centerInit, pq centerInit) {
+	pointer.coarseOptions.init = coarse
+	pointer.pqOptions.init = pq
+}
+
+// 设置粗聚类与pq码本训练的停止条件 maxIterations为最大迭代轮数，tolerance为相对代价下降的阈值，
+// shiftTolerance为聚簇中心最大移动距离的阈值，取值含义见kmeansOptions
+func (pointer *IvfPQ) setConvergence(maxIterations int, tolerance float64, shiftTolerance float64) {
+	for _, options := range []*kmeansOptions{&pointer.coarseOptions, &pointer.pqOptions} {
+		options.maxIterations = maxIterations
+		options.tolerance = tolerance
+		options.shiftTolerance = shiftTolerance
+	}
+}
+
+// 设置粗聚类与pq码本训练中空簇的重新选取方式，默认为分裂最大的簇
+func (pointer *IvfPQ) setEmptyReseed(method emptyReseed) {
+	pointer.coarseOptions.reseed = method
+	pointer.pqOptions.reseed = method
+}
+
+// 粗聚类使用小批量k-means，参数含义见Kmeans.useMiniBatch，pq码本的采样点较少，仍按完整的k-means训练
+func (pointer *IvfPQ) useMiniBatch(batchSize int, epochs int) {
+	pointer.batchSize = batchSize
+	pointer.epochs = epochs
+}
+
+// 均衡粗聚类与分桶，参数含义见Kmeans.useBalance，pq码本不使用均衡惩罚
+func (pointer *IvfPQ) useBalance(maxBucketSize int, penalty float64) {
+	pointer.maxBucketSize = maxBucketSize
+	pointer.coarseOptions.balance = penalty
+}
+
+// 读取数据与桶文件时严格检查，按options报告或跳过格式错误、维度错误、非有限值与零向量
+func (pointer *IvfPQ) useStrictIngest(options *ingestOptions) {
+	pointer.ingest = options
+}
+
+// 粗聚心已加载而粗量化器尚未建立时建立粗量化器
+func (pointer *IvfPQ) buildQuantizer() {
+	if pointer.quantizer.graph == nil {
+		pointer.quantizer.build(pointer.center, pointer.random.Int63(), pointer.metric)
+	}
+}
+
+// 余弦度量下把向量归一化，之后按内积处理
+func (pointer *IvfPQ) normalize(vector *floatVector) {
+	if pointer.metric != Cosine {
+		return
+	}
+	module := vector.GetModule()
+	if module == 0 {
+		return
+	}
+	for i := range vector.vector {
+		vector.vector[i] /= module
+	}
+}
+
+// 生成查询向量在桶bucket中的查找表，dim为每个量化区块维度
+// 返回的base为与各区块无关的得分部分，table[i][j]为第i段与第j个pq聚心的得分，
+// 向量的得分即为base加上各段编码对应得分之和
+func (pointer *IvfPQ) lookupTable(inputVector floatVector, bucket int, dim int) (base float64, table [][]float64) {
+	query := NewFloatVector(inputVector.length)
+	query.SetVector(inputVector.vector)
+	if pointer.residual == true {
+		if pointer.metric == L2 {
+			// ||q-c-r||^2 需要用q-c与残差编码比较
+			query.subVector(*pointer.center.vectorAt(bucket))
+		} else {
+			base = pointer.residualBase(*query, bucket)
 		}
-		if distance > maxDistance {
-			maxDistance = distance
-			maxIndex = i
+	}
+	// 余弦度量的向量已归一化，按内积计算
+	m := pointer.metric
+	if m == Cosine {
+		m = InnerProduct
+	}
+	// 使用OPQ时pq码本在旋转后的空间中
+	rotated := rotateVector(pointer.rotation, query.vector)
+	table = make([][]float64, pointer.M)
+	for i := 0; i < pointer.M; i++ {
+		tempvector := toFloat32(rotated[i*dim : (i+1)*dim])
+		table[i] = make([]float64, pointer.pqCenter[i].rows)
+		for j := range table[i] {
+			table[i][j] = m.score32(tempvector, pointer.pqCenter[i].row(j))
 		}
 	}
+	return base, table
+}
+
+// 残差版本在内积与余弦度量下与桶有关的得分部分：q·(c+r) = q·c + q·r，返回q·c
+func (pointer *IvfPQ) residualBase(query floatVector, bucket int) float64 {
+	return InnerProduct.score32(toFloat32(query.vector), pointer.center.row(bucket))
+}
+
+
+// 为一个向量的每一块生成编号，编号按最小重建误差选取，与索引的距离度量无关
+func (pointer *IvfPQ) getCode(clusterPoint *floatMatrix, vector *floatVector, ch chan int) {
+	maxIndex, _ := nearestIndex(toFloat32(vector.vector), clusterPoint, L2)
 	ch <- maxIndex
 }
 
@@ -53,17 +189,29 @@ func (pointer *IvfPQ) getCode(clusterPoint *floatVectors, vector *floatVector, c
 func (pointer *IvfPQ) createIndex(dataPath string, length int, num int, pqNum int, bucketExist bool) {
 	if bucketExist == false {
 		kmeans := NewKmeans()
-		kmeans.createIndex(dataPath, length, num)
+		kmeans.setSeed(pointer.random.Int63())
+		kmeans.setMetric(pointer.metric)
+		kmeans.quantizer = hnswQuantizer{M: pointer.quantizer.M, ef: pointer.quantizer.ef, efSearch: pointer.quantizer.efSearch}
+		kmeans.usePCA(pointer.pca)
+		kmeans.useStrictIngest(pointer.ingest)
+		kmeans.options = pointer.coarseOptions
+		kmeans.useMiniBatch(pointer.batchSize, pointer.epochs)
+		kmeans.useBalance(pointer.maxBucketSize, pointer.coarseOptions.balance)
+		if _, err := kmeans.createIndex(dataPath, length, num); err != nil {
+			fmt.Print(err)
+			return
+		}
 		kmeans.storeIndex(dataPath, length, "bucket", num)
+		pointer.center = kmeans.center
+		pointer.coarseReport = kmeans.report
+		pointer.buckets = kmeans.buckets
+		pointer.pca = kmeans.pca
+		// 桶内为降维后的向量
+		length = pointer.pca.dim(length)
 	} else {
-		centerFloat, _ := loadData("bucket/center.csv", 1024)
-		vectors := NewFloatVectors()
-		for _, vectorFloat := range centerFloat {
-			vector := NewFloatVector(length)
-			vector.SetVector(vectorFloat)
-			vectors.Append(*vector)
-		}
-		pointer.center = vectors
+		pointer.pca = loadTransformIfExist(pointer.pca, "bucket/pca.bin")
+		length = pointer.pca.dim(length)
+		pointer.center = loadCenter("bucket/center.csv", length)
 	}
 	rd, err := ioutil.ReadDir("bucket")
 	if err != nil {
@@ -71,69 +219,79 @@ func (pointer *IvfPQ) createIndex(dataPath string, length int, num int, pqNum in
 	}
 	// 每个量化区块维度
 	dim := length / pointer.M
-	// 为bucket下的目录排序，按数值，略过center文件
+	// 为bucket下的目录排序，按数值，略过center与pca文件
 	listDirs := make([]string, 0)
 	for _, fi := range rd {
-		if fi.Name() == "center.csv" {
+		if fi.Name() == "center.csv" || fi.Name() == "pca.bin" {
 			continue
 		}
 		listDirs = append(listDirs, fi.Name())
 	}
 	listDirs = dirSort(listDirs)
-	pointer.pqCenter = make([]*floatVectors, pointer.M)
+	pointer.pqCenter = make([]*floatMatrix, pointer.M)
 	// 遍历目录 对每个桶做均匀采样
 	sampling := 512
-	sampleData := NewFloatVectors()
-	var mu sync.Mutex
+	sampleData := NewFloatMatrix(0, length)
+	// 每个桶的采样结果放在各自的位置，最后按桶顺序合并，保证采样结果与加载顺序无关
+	samples := make([]*floatMatrix, len(listDirs))
+	var wg sync.WaitGroup
 	sem := make(semaphore, 4)
 
 	for i, listDir := range listDirs {
 		// 获取[][]floats格式数据, 采样大小默认为聚簇点*256, sampleData 为采样结果
 		sem.P(1)
+		wg.Add(1)
 		fmt.Print("start reading bucket\n")
-		go func(i int, listDir string) {
+		go func(i int, listDir string, random *rand.Rand) {
+			defer wg.Done()
 			defer sem.V(1)
-			_, data, _ := loadBucket("bucket"+"/"+listDir, length)
-			if sampling >= len(data) {
+			samples[i] = NewFloatMatrix(0, length)
+			_, data, err := loadBucketWith("bucket"+"/"+listDir, length, pointer.ingest)
+			if err != nil {
+				fmt.Print(err)
+				return
+			}
+			if sampling >= data.rows {
 				fmt.Print("数据量过少,请减少聚簇点数")
 			}
 			randArray := make([]int, sampling)
-			rand.Seed(time.Now().Unix())
-			copy(randArray, rand.Perm(len(data))[:sampling])
+			copy(randArray, random.Perm(data.rows)[:sampling])
 			for _, index := range randArray {
-				vector := NewFloatVector(length)
-				vector.SetVector(data[index])
+				vector := data.vectorAt(index)
+				pointer.normalize(vector)
 				if pointer.residual == true{
-					vector.subVector(pointer.center.vectors[i])
+					vector.subVector(*pointer.center.vectorAt(i))
 				}
-				mu.Lock()
-				sampleData.Append(*vector)
-				mu.Unlock()
+				samples[i].appendFloat64(vector.vector)
 			}
-		}(i, listDir)
+		}(i, listDir, newRand(pointer.random.Int63()))
 	}
-	for {
-		if len(sem) == 0 {
-			fmt.Print("完成聚类采样")
-			break
-		}
+	wg.Wait()
+	fmt.Print("完成聚类采样")
+	for _, sample := range samples {
+		sampleData.appendMatrix(sample)
+	}
+	// 使用OPQ时先学习旋转，pq码本在旋转后的采样点上训练
+	if pointer.opqIterations > 0 {
+		pointer.rotation = trainRotation(sampleData, pointer.M, pqNum, pointer.opqIterations, pointer.random, pointer.pqOptions)
+		sampleData = rotateRows(pointer.rotation, sampleData)
 	}
 	//每个采样区划分为八块
 	sem = make(semaphore, 3)
+	pointer.pqReports = make([]*kmeansReport, pointer.M)
 	for i := 0; i < pointer.M; i++ {
 		sem.P(1)
-		go func(i int) {
+		wg.Add(1)
+		go func(i int, random *rand.Rand) {
+			defer wg.Done()
 			defer sem.V(1)
-			cuttedSampleData, _ := sampleData.cutVectors(dim, i*dim, (i+1)*dim)
-			pointer.pqCenter[i] = searchCenter(pqNum, dim, cuttedSampleData, i)
-		}(i)
-	}
-	for {
-		if len(sem) == 0 {
-			fmt.Print("pq聚心完成")
-			break
-		}
+			cuttedSampleData := sampleData.cutColumns(i*dim, (i+1)*dim)
+			// pq码本按最小重建误差训练
+			pointer.pqCenter[i], pointer.pqReports[i] = searchCenter(pqNum, dim, cuttedSampleData, i, random, L2, pointer.pqOptions)
+		}(i, newRand(pointer.random.Int63()))
 	}
+	wg.Wait()
+	fmt.Print("pq聚心完成")
 }
 
 // path为根路径， length为向量维度
@@ -142,10 +300,13 @@ func (pointer *IvfPQ) storeIndex(dataPath string, length int, pqnum int) {
 	if err != nil {
 		fmt.Print("出错")
 	}
+	// 桶内为降维后的向量
+	pointer.pca = loadTransformIfExist(pointer.pca, "bucket/pca.bin")
+	length = pointer.pca.dim(length)
 	dim := length / pointer.M
 	listDirs := make([]string, 0)
 	for _, fi := range rd {
-		if fi.Name() == "center.csv" {
+		if fi.Name() == "center.csv" || fi.Name() == "pca.bin" {
 			continue
 		}
 		listDirs = append(listDirs, fi.Name())
@@ -155,7 +316,6 @@ func (pointer *IvfPQ) storeIndex(dataPath string, length int, pqnum int) {
 	if err != nil {
 		fmt.Print("编码桶已存在")
 	}
-	var mu sync.RWMutex
 	sem := make(semaphore, 4)
 	for i, listDir := range listDirs {
 		//为每个桶单独创建文件夹并且编码
@@ -170,31 +330,32 @@ func (pointer *IvfPQ) storeIndex(dataPath string, length int, pqnum int) {
 			}
 			defer outputFile.Close()
 			outputWriter := csv.NewWriter(outputFile)
-			indexs, data, _ := loadBucket(dataPath+"/bucket/"+listDir, length)
-			for j, floatData := range data {
-				vector := NewFloatVector(length)
-				vector.SetVector(floatData)
+			indexs, data, err := loadBucketWith(dataPath+"/bucket/"+listDir, length, pointer.ingest)
+			if err != nil {
+				fmt.Print(err)
+				return
+			}
+			rows := NewFloatMatrix(0, length)
+			for j := 0; j < data.rows; j++ {
+				vector := data.vectorAt(j)
+				pointer.normalize(vector)
 				// 如果要生成残差版本的编号，这里要采用yi-cyi
 				if pointer.residual == true{
-					vector.subVector(pointer.center.vectors[i])
+					vector.subVector(*pointer.center.vectorAt(i))
 				}
+				rows.appendFloat64(vector.vector)
+			}
+			rows = rotateRows(pointer.rotation, rows)
+			// 每一段整桶一起分块编码，编号按最小重建误差选取
+			codes := make([][]int, pointer.M)
+			for k := 0; k < pointer.M; k++ {
+				codes[k], _ = nearestRows(rows.cutColumns(k*dim, (k+1)*dim), pointer.pqCenter[k], L2)
+			}
+			for j := 0; j < data.rows; j++ {
 				code := make([]string, pointer.M)
-				var wg sync.WaitGroup
 				for k := 0; k < pointer.M; k++ {
-					wg.Add(1)
-					// 为某桶内某一向量
-					go func(k int) {
-						defer wg.Done()
-						tempvector, _ := vector.cutVector(dim, k*dim, (k+1)*dim)
-						ch := make(chan int)
-						mu.RLock()
-						go pointer.getCode(pointer.pqCenter[k], tempvector, ch)
-						mu.RUnlock()
-						tempcode := <-ch
-						code[k] = strconv.Itoa(tempcode)
-					}(k)
+					code[k] = strconv.Itoa(codes[k][j])
 				}
-				wg.Wait()
 				outputStrings := make([]string, 0)
 				outputStrings = append([]string{strconv.Itoa(indexs[j])},code...)
 				outputWriter.Write(outputStrings)
@@ -224,13 +385,18 @@ func (pointer *IvfPQ) storeIndex(dataPath string, length int, pqnum int) {
 	defer centerFile.Close()
 	outputWriter := csv.NewWriter(centerFile)
 	for i := 0; i < pointer.M; i++ {
-		for j := 0; j < pointer.pqCenter[i].length; j++ {
-			outputWriter.Write(pointer.pqCenter[i].vectorString(j))
+		for j := 0; j < pointer.pqCenter[i].rows; j++ {
+			outputWriter.Write(pointer.pqCenter[i].rowString(j))
 		}
 		// 记录M的分割位置
 		outputWriter.Write([]string{"||"})
 	}
 	outputWriter.Flush()
+	if pointer.rotation != nil {
+		if err := storeRotation(dataPath+"/pqCode/rotation.csv", pointer.rotation); err != nil {
+			fmt.Print(err)
+		}
+	}
 }
 
 // 查找最匹配的向量
@@ -238,130 +404,134 @@ func (pointer *IvfPQ) searchVector(inputVector floatVector, length int, root str
 	if _, err := os.Stat(root); os.IsNotExist(err) {
 		fmt.Print("文件不存在")
 	}
+	// 建立索引时使用了降维则先对输入向量降维
+	pointer.pca = loadTransformIfExist(pointer.pca, root+"/bucket/pca.bin")
+	inputVector, err := pointer.pca.applyVector(inputVector)
+	if err != nil {
+		fmt.Print(err)
+		return 0, math.Inf(-1)
+	}
+	length = pointer.pca.dim(length)
+	dim := length / pointer.M
 	if pointer.center == nil {
-		pointer.center = loadCenter(root + "/bucket/center.csv")
+		pointer.center = loadCenter(root+"/bucket/center.csv", length)
 	}
 	if pointer.pqCenter == nil {
-		pointer.pqCenter = make([]*floatVectors, pointer.M)
-		pointer.pqCenter = loadPqcenter(root+"/pqCode/center.csv", pointer.M)
+		pointer.pqCenter = loadPqcenter(root+"/pqCode/center.csv", pointer.M, dim)
 	}
-	dim := length / pointer.M
-	pqList := make([][]float64, pointer.M)
-	for i := range pqList {
-		pqList[i] = make([]float64, 0)
+	if pointer.rotation == nil {
+		pointer.rotation = loadRotation(root+"/pqCode/rotation.csv", length)
 	}
+	query := NewFloatVector(length)
+	query.SetVector(inputVector.vector)
+	pointer.normalize(query)
 
-	// 找到最近粗聚点
-	maxIndex, maxDistance := 0, -100000.0
-	for index, vector := range pointer.center.vectors {
-		distance, err := vector.distance(inputVector, true)
-		if err != nil {
-			fmt.Print("计算出错")
-		}
-		if distance > maxDistance {
-			maxDistance = distance
-			maxIndex = index
-		}
-	}
-	// 输入与粗聚点距离
-	dis := maxDistance
-	// 记录输入向量与pa聚心的距离
-	for i := 0; i < pointer.M; i++ {
-		tempvector, _ := inputVector.cutVector(dim, i*dim, (i+1)*dim)
-		for _, vector := range pointer.pqCenter[i].vectors {
-			// 本处得到的是 待查找向量与第i段 第vector个pqcenter的距离
-			distance, _ := vector.distance(*tempvector, true)
-
-			pqList[i] = append(pqList[i], distance)
-		}
+	// 找到最近的nprobe个粗聚点
+	pointer.buildQuantizer()
+	buckets := pointer.quantizer.nearestBuckets(pointer.center, *query, pointer.nprobe, pointer.metric)
+	// 记录输入向量与pq聚心的得分，L2残差版本的查找表与桶有关，需要每个桶单独生成，
+	// 其余情况查找表在各桶间共用，但残差版本的基础得分仍与桶有关
+	var base float64
+	var pqList [][]float64
+	perBucket := pointer.residual == true && pointer.metric == L2
+	if !perBucket {
+		_, pqList = pointer.lookupTable(*query, buckets[0].index, dim)
 	}
 
-	inputFile, inputError := os.Open(root + "/pqCode/" + strconv.Itoa(maxIndex) + ".csv")
-	if inputError != nil {
-		fmt.Printf("An error occurred on opening the inputfile\n" +
-			"Does the file exist?\n" +
-			"Have you got acces to it?\n")
-	}
-	defer inputFile.Close()
-	inputReader := csv.NewReader(inputFile)
-	maxIndex, maxDistance = 0, -100000.0
-	for {
-		inputString, readerError := inputReader.Read()
-		if readerError == io.EOF {
-			break
+	maxIndex, maxDistance := 0, math.Inf(-1)
+	for _, bucket := range buckets {
+		inputFile, inputError := os.Open(root + "/pqCode/" + strconv.Itoa(bucket.index) + ".csv")
+		if inputError != nil {
+			fmt.Printf("An error occurred on opening the inputfile\n" +
+				"Does the file exist?\n" +
+				"Have you got acces to it?\n")
+			continue
 		}
-		indexString := inputString[0]
-		index, _ := strconv.Atoi(indexString)
-		inputString = inputString[1:]
-		distance := 0.0
-		for i, element := range inputString {
-			code, _ := strconv.Atoi(element)
-			distance += pqList[i][code]
+		if perBucket {
+			base, pqList = pointer.lookupTable(*query, bucket.index, dim)
+		} else if pointer.residual == true {
+			base = pointer.residualBase(*query, bucket.index)
 		}
-		if distance > maxDistance {
-			maxDistance = distance
-			maxIndex = index
+		inputReader := csv.NewReader(inputFile)
+		for {
+			inputString, readerError := inputReader.Read()
+			if readerError == io.EOF {
+				break
+			}
+			indexString := inputString[0]
+			index, _ := strconv.Atoi(indexString)
+			inputString = inputString[1:]
+			// 查找表的基础得分加上各段pq编码得分
+			distance := base
+			for i, element := range inputString {
+				code, _ := strconv.Atoi(element)
+				distance += pqList[i][code]
+			}
+			if distance > maxDistance {
+				maxDistance = distance
+				maxIndex = index
+			}
 		}
+		inputFile.Close()
 	}
-	return maxIndex, maxDistance +dis
+	return maxIndex, maxDistance
 }
 
 func (pointer *IvfPQ) testVector(inputVector floatVector, length int, root string) (int, float64) {
 	if _, err := os.Stat(root); os.IsNotExist(err) {
 		fmt.Print("文件不存在")
 	}
+	// 建立索引时使用了降维则先对输入向量降维
+	pointer.pca = loadTransformIfExist(pointer.pca, root+"/bucket/pca.bin")
+	inputVector, err := pointer.pca.applyVector(inputVector)
+	if err != nil {
+		fmt.Print(err)
+		return 0, math.Inf(-1)
+	}
+	length = pointer.pca.dim(length)
+	dim := length / pointer.M
 	if pointer.center == nil {
-		pointer.center = loadCenter(root + "/bucket/center.csv")
+		pointer.center = loadCenter(root+"/bucket/center.csv", length)
 	}
 	if pointer.pqCenter == nil {
-		pointer.pqCenter = make([]*floatVectors, pointer.M)
-		pointer.pqCenter = loadPqcenter(root+"/pqCode/center.csv", pointer.M)
+		pointer.pqCenter = loadPqcenter(root+"/pqCode/center.csv", pointer.M, dim)
 	}
-	dim := length / pointer.M
 	pqList := make([][]float64, pointer.M)
 	for i := range pqList {
 		pqList[i] = make([]float64, 0)
 	}
 
 	// 找到最近粗聚点
-	maxIndex, maxDistance := 0, -100000.0
-	for index, vector := range pointer.center.vectors {
-		distance, err := vector.distance(inputVector, true)
-		if err != nil {
-			fmt.Print("计算出错")
-		}
-		if distance > maxDistance {
-			maxDistance = distance
-			maxIndex = index
-		}
-	}
+	pointer.buildQuantizer()
+	nearest := pointer.quantizer.nearestBuckets(pointer.center, inputVector, 1, pointer.metric)[0]
+	maxIndex, maxDistance := nearest.index, nearest.distance
 	// 输入与粗聚点距离
 	dis := maxDistance
 	// 记录输入向量与pa聚心的距离
 	for i := 0; i < pointer.M; i++ {
-		tempvector, _ := inputVector.cutVector(dim, i*dim, (i+1)*dim)
-		for _, vector := range pointer.pqCenter[i].vectors {
-			// 本处得到的是 待查找向量与第i段 第vector个pqcenter的距离
-			distance, _ := vector.distance(*tempvector, true)
+		tempvector := toFloat32(inputVector.vector[i*dim : (i+1)*dim])
+		for j := 0; j < pointer.pqCenter[i].rows; j++ {
+			// 本处得到的是 待查找向量与第i段 第j个pqcenter的距离
+			distance := pointer.metric.score32(tempvector, pointer.pqCenter[i].row(j))
 
 			pqList[i] = append(pqList[i], distance)
 		}
 	}
 	// ri
-	x := NewFloatVector(1024)
+	x := NewFloatVector(length)
 	x.SetVector(inputVector.vector)
 	// 此时input为ri
-	inputVector.subVector(pointer.center.vectors[maxIndex])
+	inputVector.subVector(*pointer.center.vectorAt(maxIndex))
 	for i := 0; i < pointer.M; i++{
 		tempvector, _ := inputVector.cutVector(dim, i*dim, (i+1)*dim)
 		tempx,_ := x.cutVector(dim, i*dim, (i+1)*dim)
-		tdis,_ := tempvector.distance(*tempx, true)
+		tdis := tempvector.score(*tempx, pointer.metric)
 		fmt.Printf("第i段x*r:%f\n",tdis)
 		ch := make(chan int)
 		go pointer.getCode(pointer.pqCenter[i], tempvector, ch)
 		tempcode := <-ch
-		pq := pointer.pqCenter[i].vectors[tempcode]
-		pqdis,_ := tempvector.distance(pq, true)
+		pq := pointer.pqCenter[i].vectorAt(tempcode)
+		pqdis := tempvector.score(*pq, pointer.metric)
 		fmt.Printf("第一段pq编码：%f\n", pqdis*8)
 	}
 	return maxIndex, maxDistance +dis
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"math"
+	"runtime"
+	"sync"
+)
+
+// 分块计算得分时每块的查询行数与聚心行数，一块聚心在块内的所有查询间复用，使其留在缓存中
+const (
+	kernelQueryTile  = 16
+	kernelCenterTile = 64
+	// 并行计算时每个协程一次处理的查询行数
+	kernelChunk = 256
+)
+
+// 两个等长float32向量的内积，四路展开以减少循环开销
+func dot32(a []float32, b []float32) float32 {
+	b = b[:len(a)]
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(a); i += 4 {
+		s0 += a[i] * b[i]
+		s1 += a[i+1] * b[i+1]
+		s2 += a[i+2] * b[i+2]
+		s3 += a[i+3] * b[i+3]
+	}
+	for ; i < len(a); i++ {
+		s0 += a[i] * b[i]
+	}
+	return s0 + s1 + s2 + s3
+}
+
+// 返回每一行模长的平方
+func (pointer *floatMatrix) sqNorms() []float32 {
+	norms := make([]float32, pointer.rows)
+	for i := range norms {
+		row := pointer.row(i)
+		norms[i] = dot32(row, row)
+	}
+	return norms
+}
+
+// 由内积与两个向量模长的平方得到度量m下的得分，规则与score32相同
+func (m Metric) fromDot(dot float32, normA float32, normB float32) float64 {
+	switch m {
+	case Cosine:
+		if normA == 0 || normB == 0 {
+			return 0
+		}
+		return float64(dot) / math.Sqrt(float64(normA)*float64(normB))
+	case L2:
+		// ||a-b||^2 = ||a||^2 - 2a·b + ||b||^2，舍入误差可能使其略小于0
+		distance := normA - 2*dot + normB
+		if distance < 0 {
+			distance = 0
+		}
+		return -float64(distance)
+	}
+	return float64(dot)
+}
+
+// 一个查询向量q对矩阵rows的每一行打分，结果写入out，out长度需不小于rows.rows
+// norms为rows每一行模长的平方，为nil时现场计算
+func (m Metric) scoreRows(q []float32, rows *floatMatrix, norms []float32, out []float64) {
+	if norms == nil && m != InnerProduct {
+		norms = rows.sqNorms()
+	}
+	qNorm := dot32(q, q)
+	for i := 0; i < rows.rows; i++ {
+		dot := dot32(q, rows.row(i))
+		if m == InnerProduct {
+			out[i] = float64(dot)
+			continue
+		}
+		out[i] = m.fromDot(dot, qNorm, norms[i])
+	}
+}
+
+// 一块查询queries对一块聚心centers打分，out[i*centers.rows+j]为第i个查询与第j个聚心的得分
+// 按kernelQueryTile*kernelCenterTile分块计算内积，qNorms与cNorms为两者每一行模长的平方
+func (m Metric) scoreBlock(queries *floatMatrix, qNorms []float32, centers *floatMatrix, cNorms []float32, out []float64) {
+	for i0 := 0; i0 < queries.rows; i0 += kernelQueryTile {
+		i1 := minInt(i0+kernelQueryTile, queries.rows)
+		for j0 := 0; j0 < centers.rows; j0 += kernelCenterTile {
+			j1 := minInt(j0+kernelCenterTile, centers.rows)
+			for i := i0; i < i1; i++ {
+				q := queries.row(i)
+				line := out[i*centers.rows : (i+1)*centers.rows]
+				for j := j0; j < j1; j++ {
+					dot := dot32(q, centers.row(j))
+					if m == InnerProduct {
+						line[j] = float64(dot)
+						continue
+					}
+					line[j] = m.fromDot(dot, qNorms[i], cNorms[j])
+				}
+			}
+		}
+	}
+}
+
+// 矩阵rows中与q得分最高的行，返回其行号与得分，rows为空时返回-1
+func (m Metric) bestRow(q []float32, rows *floatMatrix, norms []float32) (int, float64) {
+	if rows.rows == 0 {
+		return -1, math.Inf(-1)
+	}
+	out := make([]float64, rows.rows)
+	m.scoreRows(q, rows, norms, out)
+	maxIndex := 0
+	for i, distance := range out {
+		if distance > out[maxIndex] {
+			maxIndex = i
+		}
+	}
+	return maxIndex, out[maxIndex]
+}
+
+// 为queries的每一行找到centers中得分最高的行，返回行号与得分
+func nearestRows(queries *floatMatrix, centers *floatMatrix, m Metric) ([]int, []float64) {
+	return nearestRowsPenalized(queries, centers, m, nil)
+}
+
+// 与nearestRows相同，但按得分减去penalty[j]选取最近的行，返回的得分不含惩罚，penalty为nil时不惩罚
+func nearestRowsPenalized(queries *floatMatrix, centers *floatMatrix, m Metric, penalty []float64) ([]int, []float64) {
+	indexs := make([]int, queries.rows)
+	distances := make([]float64, queries.rows)
+	scanRows(queries, centers, m, func(i int, line []float64) {
+		maxIndex, maxDistance := 0, math.Inf(-1)
+		for j, distance := range line {
+			if penalty != nil {
+				distance -= penalty[j]
+			}
+			if distance > maxDistance {
+				maxIndex, maxDistance = j, distance
+			}
+		}
+		indexs[i], distances[i] = maxIndex, line[maxIndex]
+	})
+	return indexs, distances
+}
+
+// 为queries的每一行找到centers中得分最高的r行，按得分由高到低排列
+func nearestRowsTop(queries *floatMatrix, centers *floatMatrix, m Metric, r int) [][]int {
+	r = minInt(r, centers.rows)
+	result := make([][]int, queries.rows)
+	scanRows(queries, centers, m, func(i int, line []float64) {
+		// 插入排序维护得分最高的r行
+		top := make([]int, 0, r+1)
+		for j, distance := range line {
+			if len(top) == r && distance <= line[top[r-1]] {
+				continue
+			}
+			k := len(top)
+			if k < r {
+				top = append(top, j)
+			} else {
+				k = r - 1
+			}
+			for ; k > 0 && line[top[k-1]] < distance; k-- {
+				top[k] = top[k-1]
+			}
+			top[k] = j
+		}
+		result[i] = top
+	})
+	return result
+}
+
+// 计算queries每一行与centers所有行的得分，对第i行调用visit(i, 得分)，line在visit返回后被复用
+// 查询按kernelChunk行分段，由固定数量的协程并行分块计算，每行只被一个协程访问，结果与协程调度无关
+func scanRows(queries *floatMatrix, centers *floatMatrix, m Metric, visit func(i int, line []float64)) {
+	if queries.rows == 0 || centers.rows == 0 {
+		return
+	}
+	var cNorms []float32
+	if m != InnerProduct {
+		cNorms = centers.sqNorms()
+	}
+	var wg sync.WaitGroup
+	sem := make(semaphore, runtime.NumCPU())
+	for start := 0; start < queries.rows; start += kernelChunk {
+		sem.P(1)
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			defer sem.V(1)
+			chunk := queries.rowRange(start, minInt(start+kernelChunk, queries.rows))
+			var qNorms []float32
+			if m != InnerProduct {
+				qNorms = chunk.sqNorms()
+			}
+			out := make([]float64, chunk.rows*centers.rows)
+			m.scoreBlock(chunk, qNorms, centers, cNorms, out)
+			for i := 0; i < chunk.rows; i++ {
+				visit(start+i, out[i*centers.rows:(i+1)*centers.rows])
+			}
+		}(start)
+	}
+	wg.Wait()
+}
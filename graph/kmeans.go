@@ -9,11 +9,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"strconv"
 	"sync"
-	"time"
 )
 
 type Empty interface{}
@@ -34,16 +34,113 @@ func (s semaphore) V(n int) {
 	}
 }
 
-// Kmeans Kmeans索引
+// Kmeans Kmeans索引, random为采样与初始化聚簇中心使用的随机数生成器
+// quantizer为寻找最近桶使用的粗量化器, nprobe为查找时搜索的桶个数, metric为距离度量
+// pca为放在索引之前的降维变换，为nil表示不降维，聚类、分桶与查找都在降维后的空间中进行
+// sq为桶内向量的标量量化器，为nil时桶内储存原始精度的csv，否则储存编码后的定长记录
+// ingest为读取数据文件的严格载入设置，为nil时宽松载入，options为聚类训练的设置，report为最近一次聚类的训练报告
+// batchSize与epochs为小批量模式的批大小与最大轮数，batchSize为0表示不使用小批量，epochs不大于0时取默认值
+// maxBucketSize为分桶时每个桶的最大向量数，为0表示不限制，buckets为最近一次分桶的桶大小报告
 type Kmeans struct {
-	root    string
-	vectors *floatVectors
-	center  *floatVectors
+	root      string
+	vectors   *floatMatrix
+	center    *floatMatrix
+	random    *rand.Rand
+	quantizer hnswQuantizer
+	nprobe    int
+	metric    Metric
+	pca       *PCA
+	sq        *scalarQuantizer
+	ingest    *ingestOptions
+	options   kmeansOptions
+	report    *kmeansReport
+	batchSize int
+	epochs    int
+	maxBucketSize int
+	buckets   *bucketReport
 }
 
-// NewKmeans 向外生产一个Kmeans
+// NewKmeans 向外生产一个Kmeans，默认以当前时间为随机种子
 func NewKmeans() *Kmeans {
-	return &Kmeans{}
+	return &Kmeans{random: newTimeRand()}
+}
+
+// 设置随机种子，种子相同且数据相同时建立的索引完全一致
+func (pointer *Kmeans) setSeed(seed int64) {
+	pointer.random = newRand(seed)
+}
+
+// 在聚心上建立hnsw图作为粗量化器，用于分桶与查找，适用于聚心很多的情况
+// M与ef为hnsw的建图参数，efSearch为查找时的动态表大小
+func (pointer *Kmeans) useHnswQuantizer(M int, ef int, efSearch int) {
+	pointer.quantizer = hnswQuantizer{M: M, ef: ef, efSearch: efSearch}
+}
+
+// 设置距离度量，需在建立索引前设置，查找时也需使用相同的度量
+func (pointer *Kmeans) setMetric(m Metric) {
+	pointer.metric = m
+}
+
+// 设置查找时搜索的桶个数
+func (pointer *Kmeans) setNprobe(nprobe int) {
+	pointer.nprobe = nprobe
+}
+
+// 在索引之前加入降维变换，未训练时在建立索引的采样点上训练，并随桶一起保存为pca.bin
+func (pointer *Kmeans) usePCA(pca *PCA) {
+	pointer.pca = pca
+}
+
+// 桶内向量使用标量量化储存，kind为SQ8、SQ4或FP16，量化参数在建立索引的采样点上训练，并随桶一起保存为sq.bin
+// 每个桶存为编号.sq，查找时直接在编码上计算得分
+func (pointer *Kmeans) useScalarQuantizer(kind sqType) {
+	pointer.sq = NewScalarQuantizer(kind)
+}
+
+// 设置聚类初始聚簇中心的选取方式，默认为随机选取
+func (pointer *Kmeans) setCenterInit(method centerInit) {
+	pointer.options.init = method
+}
+
+// 设置聚类的停止条件 maxIterations为最大迭代轮数，tolerance为相对代价下降的阈值，
+// shiftTolerance为聚簇中心最大移动距离的阈值，取值含义见kmeansOptions
+func (pointer *Kmeans) setConvergence(maxIterations int, tolerance float64, shiftTolerance float64) {
+	pointer.options.maxIterations = maxIterations
+	pointer.options.tolerance = tolerance
+	pointer.options.shiftTolerance = shiftTolerance
+}
+
+// 设置聚类中空簇的重新选取方式，默认为分裂最大的簇
+func (pointer *Kmeans) setEmptyReseed(method emptyReseed) {
+	pointer.options.reseed = method
+}
+
+// 使用小批量k-means训练聚心，适用于数据量与聚心都很多的情况：只采样少量点选取初始中心，
+// 之后每轮流式读取数据目录，以batchSize大小的随机批次更新聚心，最多epochs轮，epochs不大于0时最多miniBatchEpochs轮，收敛条件与setConvergence相同
+func (pointer *Kmeans) useMiniBatch(batchSize int, epochs int) {
+	pointer.batchSize = batchSize
+	pointer.epochs = epochs
+}
+
+// 均衡分桶 penalty为聚类时对大簇的均衡惩罚，取值含义见kmeansOptions，小批量模式下不使用；
+// maxBucketSize为分桶时每个桶的最大向量数，桶满后向量依次放入次近的桶，最近的balanceCandidates个桶都满时仍放入最近的桶
+// 分桶结束后打印分桶前后的桶大小分布
+func (pointer *Kmeans) useBalance(maxBucketSize int, penalty float64) {
+	pointer.maxBucketSize = maxBucketSize
+	pointer.options.balance = penalty
+}
+
+// 读取数据文件时严格检查，按options报告或跳过格式错误、维度错误、非有限值与零向量
+// 跳过的行不占用编号，向量编号仍为其在按数值排序后的文件中的行序号
+func (pointer *Kmeans) useStrictIngest(options *ingestOptions) {
+	pointer.ingest = options
+}
+
+// 聚心已产生而粗量化器尚未建立时建立粗量化器
+func (pointer *Kmeans) buildQuantizer() {
+	if pointer.quantizer.graph == nil {
+		pointer.quantizer.build(pointer.center, pointer.random.Int63(), pointer.metric)
+	}
 }
 
 // 建立索引并返回建立索引后的索引位置 len表示向量维度长度,num 表示 聚簇点个数
@@ -53,43 +150,68 @@ func (pointer *Kmeans) createIndex(dataPath string, length int, num int) (string
 		fmt.Print("出错")
 	}
 	sampling := num * 256 / len(rd)
-	pointer.vectors = NewFloatVectors()
-	var mu sync.Mutex
+	if pointer.batchSize > 0 {
+		// 小批量模式只保留选取初始中心所需的少量采样点
+		sampling = (num*miniBatchSampling + len(rd) - 1) / len(rd)
+	}
+	pointer.vectors = NewFloatMatrix(0, length)
+	// 每个文件的采样结果放在各自的位置，最后按文件顺序合并，保证采样结果与加载顺序无关
+	samples := make([]*floatMatrix, len(rd))
+	errs := make([]error, len(rd))
+	var wg sync.WaitGroup
 	sem := make(semaphore, 2)
-	for _, fi := range rd {
+	for i, fi := range rd {
 		sem.P(1)
+		wg.Add(1)
 		fmt.Print("start\n")
-		go func(path string) {
+		go func(i int, path string, random *rand.Rand) {
+			defer wg.Done()
 			defer sem.V(1)
-			result := make([][]float64, 0)
-			result, err = loadData(dataPath+"/"+path, length)
+			samples[i] = NewFloatMatrix(0, length)
+			result, err := loadDataWith(dataPath+"/"+path, length, pointer.ingest)
 			if err != nil {
 				fmt.Print("load data error")
+				errs[i] = err
+				return
 			}
-			if sampling >= len(result) {
+			if sampling >= result.rows {
 				fmt.Print("数据量过少,请减少聚簇点数")
 			}
-			randArray := make([]int, sampling)
-			rand.Seed(time.Now().Unix())
-			copy(randArray, rand.Perm(len(result))[:sampling])
+			randArray := random.Perm(result.rows)[:minInt(sampling, result.rows)]
 
 			for _, index := range randArray {
-				vector := NewFloatVector(length)
-				vector.SetVector(result[index])
-				mu.Lock()
-				pointer.vectors.Append(*vector)
-				mu.Unlock()
+				samples[i].appendRow(result.row(index))
 			}
 			fmt.Print("finish\n")
-		}(fi.Name())
+		}(i, fi.Name(), newRand(pointer.random.Int63()))
 	}
-	for {
-		if len(sem) == 0 {
-			fmt.Print("资源消耗完毕")
-			break
+	wg.Wait()
+	fmt.Print("资源消耗完毕")
+	for _, err := range errs {
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, sample := range samples {
+		pointer.vectors.appendMatrix(sample)
+	}
+	pointer.vectors, err = pointer.pca.fitApply(pointer.vectors, pointer.random)
+	if err != nil {
+		return "", err
+	}
+	if pointer.sq != nil && !pointer.sq.trained() {
+		if err := pointer.sq.train(pointer.vectors); err != nil {
+			return "", err
+		}
+	}
+	if pointer.batchSize > 0 {
+		files := make([]string, len(rd))
+		for i, fi := range rd {
+			files[i] = fi.Name()
 		}
+		return "", pointer.miniBatchCenter(dataPath, files, length, num)
 	}
-	pointer.searchCenter(num, length)
+	pointer.searchCenter(num, pointer.pca.dim(length))
 	return "", nil
 }
 
@@ -102,7 +224,7 @@ func (pointer *Kmeans) searchCenter(num int, length int) error {
 		return errors.New("中心数据已产生，无需搜索")
 	}
 	vectors := pointer.vectors
-	pointer.center = searchCenter(num, length, vectors, 0)
+	pointer.center, pointer.report = searchCenter(num, length, vectors, 0, pointer.random, pointer.metric, pointer.options)
 
 	return nil
 }
@@ -112,6 +234,10 @@ func (pointer *Kmeans) storeIndex(dataPath string, length int, bucketPath string
 	if pointer.center == nil {
 		return false, errors.New("聚类算法尚未运行")
 	}
+	if pointer.sq != nil && !pointer.sq.trained() {
+		return false, errors.New("标量量化器尚未训练")
+	}
+	pointer.buildQuantizer()
 	// bucket 为桶，将每个向量储存到对应的桶中，
 	// bucketIdentifier是存储编号的桶，因为每个向量有自己的编号，这样才能对应进行搜索。
 	rd, err := ioutil.ReadDir(dataPath)
@@ -130,44 +256,54 @@ func (pointer *Kmeans) storeIndex(dataPath string, length int, bucketPath string
 	listDirs = dirSort(listDirs)
 	// 记录总数 因为是多个文件
 	count := 0
+	pointer.buckets = newBucketReport(num)
 	for _, listDir := range listDirs {
-		bucket := make([]floatVectors, num)
+		bucket := make([]*floatMatrix, num)
 		bucketIdentifier := make([][]int, num)
 		for i := range bucketIdentifier {
+			bucket[i] = NewFloatMatrix(0, pointer.pca.dim(length))
 			bucketIdentifier[i] = make([]int, 0)
 		}
-		data, _ := loadData(dataPath+"/"+listDir, length)
-		var wg sync.WaitGroup
-		var mu sync.Mutex
-		for i, floatData := range data {
-			wg.Add(1)
-			go func(floatData []float64, i int) {
-				defer wg.Done()
-				maxIndex, maxDistance := 0, -100000.0
-				vector := NewFloatVector(length)
-				vector.SetVector(floatData)
-				for centerIndex, centerPoint := range pointer.center.vectors {
-					distance, err := vector.distance(centerPoint, true)
-					if err != nil {
-						fmt.Print(err)
-					}
-					if distance > maxDistance {
-						maxDistance = distance
-						maxIndex = centerIndex
-					}
+		positions, rows, records, err := loadRows(dataPath+"/"+listDir, length, false, pointer.ingest)
+		if err != nil {
+			return false, err
+		}
+		// 桶内储存降维后的向量
+		rows, err = pointer.pca.applyMatrix(rows)
+		if err != nil {
+			return false, err
+		}
+		// 整个文件一起分桶，限制桶大小时按文件顺序依次填充
+		var assigned []int
+		if pointer.maxBucketSize > 0 {
+			assigned = assignBalanced(&pointer.quantizer, pointer.center, rows, pointer.metric, pointer.maxBucketSize, pointer.buckets)
+		} else {
+			assigned = pointer.quantizer.assign(pointer.center, rows, pointer.metric)
+			for _, maxIndex := range assigned {
+				pointer.buckets.before[maxIndex]++
+				pointer.buckets.after[maxIndex]++
+			}
+		}
+		for i, maxIndex := range assigned {
+			bucket[maxIndex].appendRow(rows.row(i))
+			bucketIdentifier[maxIndex] = append(bucketIdentifier[maxIndex], positions[i]+count)
+		}
+		count += records
+		if pointer.sq != nil {
+			for i, bucketVector := range bucket {
+				codes := pointer.sq.encodeRows(bucketVector)
+				path := "./" + bucketPath + "/" + strconv.Itoa(i) + ".sq"
+				if err := writeCodeBucket(path, bucketIdentifier[i], codes, pointer.sq.codeSize()); err != nil {
+					return false, err
 				}
-				mu.Lock()
-				bucket[maxIndex].Append(*vector)
-				bucketIdentifier[maxIndex] = append(bucketIdentifier[maxIndex], i)
-				mu.Unlock()
-
-			}(floatData, i+count)
+			}
+			continue
 		}
-		count += len(data)
-		wg.Wait()
+		var wg sync.WaitGroup
+		var mu sync.Mutex
 		for i, bucketVector := range bucket {
 			wg.Add(1)
-			go func(i int, bucketVector floatVectors) {
+			go func(i int, bucketVector *floatMatrix) {
 				defer wg.Done()
 				outputFile, outputError := os.OpenFile("./"+bucketPath+"/"+strconv.Itoa(i)+".csv",
 					os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
@@ -176,8 +312,8 @@ func (pointer *Kmeans) storeIndex(dataPath string, length int, bucketPath string
 				}
 				defer outputFile.Close()
 				outputWriter := csv.NewWriter(outputFile)
-				for j := 0; j < bucketVector.length; j++ {
-					outputstrings := bucketVector.vectorString(j)
+				for j := 0; j < bucketVector.rows; j++ {
+					outputstrings := bucketVector.rowString(j)
 					outputstrings = append([]string {strconv.Itoa(bucketIdentifier[i][j])}, outputstrings...)
 					mu.Lock()
 					outputWriter.Write(outputstrings)
@@ -198,105 +334,110 @@ func (pointer *Kmeans) storeIndex(dataPath string, length int, bucketPath string
 	}
 	defer outputFile.Close()
 	outputWriter := csv.NewWriter(outputFile)
-	for j := 0; j < pointer.center.length; j++ {
-		outputStrings := pointer.center.vectorString(j)
+	for j := 0; j < pointer.center.rows; j++ {
+		outputStrings := pointer.center.rowString(j)
 		outputStrings = append([]string {strconv.Itoa(j)}, outputStrings...)
 		outputWriter.Write(outputStrings)
 	}
 	outputWriter.Flush()
+	if pointer.pca != nil {
+		if err := pointer.pca.storeTransform("./" + bucketPath + "/pca.bin"); err != nil {
+			return false, err
+		}
+	}
+	if pointer.sq != nil {
+		if err := pointer.sq.storeQuantizer("./" + bucketPath + "/sq.bin"); err != nil {
+			return false, err
+		}
+	}
+	if pointer.maxBucketSize > 0 {
+		fmt.Println(pointer.buckets)
+	}
 	return true, nil
 }
 
 // 调用查询函数查询与特征最接近的向量 inputvect为输入的待搜索向量， root 为文件路径 length为向量维度
+// 使用降维时返回的向量为降维后的向量，使用标量量化时返回的向量为由编码还原的近似向量
 func (pointer *Kmeans) searchVector(inputVector floatVector, root string, length int) (int, floatVector, float64) {
 	if _, err := os.Stat(root); os.IsNotExist(err) {
 		fmt.Print("文件不存在")
 	}
 	pointer.root = root
+	// 建立索引时使用了降维则先对输入向量降维
+	pointer.pca = loadTransformIfExist(pointer.pca, root+"/pca.bin")
+	inputVector, err := pointer.pca.applyVector(inputVector)
+	if err != nil {
+		fmt.Print(err)
+		return 0, inputVector, math.Inf(-1)
+	}
+	length = pointer.pca.dim(length)
+	pointer.sq = loadQuantizerIfExist(pointer.sq, root+"/sq.bin")
 	// 如果还没有聚簇点，那么加载聚簇点
 	if pointer.center == nil {
-		inputFile, inputError := os.Open(root + "/center.csv")
+		pointer.center = loadCenter(root+"/center.csv", length)
+	}
+	pointer.buildQuantizer()
+	// 先将输入向量特征与聚簇点匹配，找到最近的nprobe个桶
+	buckets := pointer.quantizer.nearestBuckets(pointer.center, inputVector, pointer.nprobe, pointer.metric)
+	query := toFloat32(inputVector.vector)
+	maxIndex, maxDistance := 0, math.Inf(-1)
+	maxVector := make([]float32, length)
+	for _, bucket := range buckets {
+		if pointer.sq != nil {
+			// 加载编码后的桶，直接在编码上匹配
+			indexs, codes, err := loadCodeBucket(root+"/"+strconv.Itoa(bucket.index)+".sq", pointer.sq.codeSize())
+			if err != nil {
+				fmt.Print(err)
+				continue
+			}
+			best, distance := pointer.sq.bestCode(query, codes, pointer.metric)
+			if best >= 0 && distance > maxDistance {
+				maxDistance = distance
+				maxIndex = indexs[best]
+				size := pointer.sq.codeSize()
+				maxVector = pointer.sq.decode(codes[best*size : (best+1)*size])
+			}
+			continue
+		}
+		// 加载相应的桶
+		inputFile, inputError := os.Open(root + "/" + strconv.Itoa(bucket.index) + ".csv")
 		if inputError != nil {
 			fmt.Printf("An error occurred on opening the inputfile\n" +
 				"Does the file exist?\n" +
 				"Have you got acces to it?\n")
+			continue
 		}
-		defer inputFile.Close()
-		pointer.center = NewFloatVectors()
 		inputReader := csv.NewReader(inputFile)
+		// 先把整个桶读入矩阵，再一次性与目标向量做匹配
+		indexs := make([]int, 0)
+		rows := NewFloatMatrix(0, length)
+		vector := make([]float32, length)
 		for {
 			inputString, readerError := inputReader.Read()
 			if readerError == io.EOF {
 				break
 			}
+			indexString := inputString[0]
+			index, _ := strconv.Atoi(indexString)
 			inputString = inputString[1:]
-			inputFloatArray := make([]float64, length)
 			for i, element := range inputString {
-				inputFloat, _ := strconv.ParseFloat(element, 64)
-				inputFloatArray[i] = inputFloat
+				inputFloat, _ := strconv.ParseFloat(element, 32)
+				vector[i] = float32(inputFloat)
 			}
-			vector := NewFloatVector(length)
-			vector.SetVector(inputFloatArray)
-			pointer.center.Append(*vector)
+			indexs = append(indexs, index)
+			rows.appendRow(vector)
 		}
-	}
-	// maxIndex 为获取的桶编号, 先将输入向量特征与聚簇点匹配，找到相对应的桶
-	maxIndex, maxDistance := 0, -100000.0
-	for index, vector := range pointer.center.vectors {
-		distance, err := vector.distance(inputVector, true)
-		if err != nil {
-			fmt.Print("计算出错")
-		}
-		if distance > maxDistance {
+		inputFile.Close()
+		best, distance := pointer.metric.bestRow(query, rows, nil)
+		if best >= 0 && distance > maxDistance {
 			maxDistance = distance
-			maxIndex = index
+			maxIndex = indexs[best]
+			maxVector = rows.row(best)
 		}
 	}
-	// 加载相应的桶
-	inputFile, inputError := os.Open(root + "/" + strconv.Itoa(maxIndex) + ".csv")
-	if inputError != nil {
-		fmt.Printf("An error occurred on opening the inputfile\n" +
-			"Does the file exist?\n" +
-			"Have you got acces to it?\n")
+	result := NewFloatVector(length)
+	for i, value := range maxVector {
+		result.vector[i] = float64(value)
 	}
-	defer inputFile.Close()
-	inputReader := csv.NewReader(inputFile)
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	maxIndex, maxDistance = 0, -100000.0
-	maxVector := NewFloatVector(1024)
-	// 加载桶内每个向量与目标向量做匹配
-	for {
-		inputString, readerError := inputReader.Read()
-		if readerError == io.EOF {
-			break
-		}
-		indexString := inputString[0]
-		index, _ := strconv.Atoi(indexString)
-		inputString = inputString[1:]
-		inputFloatArray := make([]float64, length)
-		for i, element := range inputString {
-			inputFloat, _ := strconv.ParseFloat(element, 64)
-			inputFloatArray[i] = inputFloat
-		}
-		vector := NewFloatVector(length)
-		vector.SetVector(inputFloatArray)
-		wg.Add(1)
-		go func(index int, vector floatVector) {
-			defer wg.Done()
-			distance, err := vector.distance(inputVector, true)
-			if err != nil {
-				fmt.Print("计算出错")
-			}
-			mu.Lock()
-			if distance > maxDistance {
-				maxDistance = distance
-				maxIndex = index
-				maxVector = &vector
-			}
-			mu.Unlock()
-		}(index, *vector)
-	}
-	wg.Wait()
-	return maxIndex, *maxVector, maxDistance
+	return maxIndex, *result, maxDistance
 }
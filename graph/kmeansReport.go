@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// 聚类训练的默认最大迭代轮数与相对代价下降阈值
+const (
+	kmeansMaxIterations = 500
+	kmeansTolerance     = 1e-4
+)
+
+// 返回最大迭代轮数，未设置时为默认值
+func (pointer kmeansOptions) iterations() int {
+	if pointer.maxIterations <= 0 {
+		return kmeansMaxIterations
+	}
+	return pointer.maxIterations
+}
+
+// 判断是否收敛：相对代价下降小于tolerance，或聚簇中心的最大移动距离小于shiftTolerance
+// 使用均衡惩罚时代价不再单调下降，按相对代价变化的绝对值判断
+func (pointer kmeansOptions) converged(previous float64, current float64, shift float64) bool {
+	tolerance := pointer.tolerance
+	if tolerance == 0 {
+		tolerance = kmeansTolerance
+	}
+	if tolerance > 0 {
+		change := previous - current
+		if pointer.balance > 0 {
+			change = math.Abs(change)
+		}
+		if previous == 0 || change/math.Abs(previous) < tolerance {
+			return true
+		}
+	}
+	return pointer.shiftTolerance > 0 && shift < pointer.shiftTolerance
+}
+
+// kmeansReport 聚类训练的报告 inertia为每轮分配后的总代价，iterations为实际迭代的轮数，converged表示是否因收敛而提前停止
+// sizes为最后一轮每个聚簇的采样点个数，reseeded为重新选取失效聚簇中心的总次数，elapsed为训练用时（包括选取初始中心）
+type kmeansReport struct {
+	inertia    []float64
+	iterations int
+	converged  bool
+	sizes      []int
+	reseeded   int
+	elapsed    time.Duration
+}
+
+// 最后一轮的总代价
+func (pointer *kmeansReport) finalInertia() float64 {
+	if len(pointer.inertia) == 0 {
+		return 0
+	}
+	return pointer.inertia[len(pointer.inertia)-1]
+}
+
+// 返回报告的摘要：迭代轮数、是否收敛、最终代价、聚簇大小的范围与用时
+func (pointer *kmeansReport) String() string {
+	smallest, largest := 0, 0
+	for i, size := range pointer.sizes {
+		if i == 0 || size < smallest {
+			smallest = size
+		}
+		if size > largest {
+			largest = size
+		}
+	}
+	state := "达到最大轮数"
+	if pointer.converged {
+		state = "已收敛"
+	}
+	return fmt.Sprintf("迭代%d轮(%s), 代价%f, 聚簇大小%d~%d, 重新选取空簇%d次, 用时%v",
+		pointer.iterations, state, pointer.finalInertia(), smallest, largest, pointer.reseeded, pointer.elapsed)
+}
+
+// 一轮分配的总代价：L2为距离平方之和，余弦为1减去余弦之和，内积为内积之和的相反数
+func inertiaOf(scores []float64, m Metric) float64 {
+	var inertia float64
+	for _, score := range scores {
+		if m == Cosine {
+			inertia += 1 - score
+		} else {
+			inertia -= score
+		}
+	}
+	return inertia
+}
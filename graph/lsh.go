@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+)
+
+// lsh索引文件的魔数与版本号，文件格式改变时需要增加版本号
+const (
+	lshMagic   = "LSHI"
+	lshVersion = 1
+	// L2度量下p稳定投影的默认桶宽
+	lshDefaultWidth = 4.0
+)
+
+// LSH 局部敏感哈希索引，无需训练，插入的向量立即可查
+// 共tables个哈希表，每个表由bits个哈希函数拼接成桶号：内积与余弦度量使用随机超平面，取投影的符号；
+// L2度量使用p稳定（高斯）投影，取(a·x+b)/width的下取整。查找时取出各表中与查询同桶的向量，再按度量精确排序
+// planes[t]为第t个表的投影矩阵（每行一个哈希函数），offsets[t]为L2度量下的偏移b，buckets[t]为桶号到行号的映射
+// vectors按行号连续存放向量，ids为每一行的外部编号，rows为外部编号到行号的映射，nextID为createIndex分配的下一个外部编号，只增不减
+// probes为每个表额外探测的相邻桶个数，random为生成投影使用的随机数生成器，ingest为createIndex的严格载入设置
+// mu保护以上结构，插入与删除持写锁，查询持读锁
+type LSH struct {
+	tables  int
+	bits    int
+	width   float64
+	probes  int
+	metric  Metric
+	planes  []*floatMatrix
+	offsets [][]float32
+	buckets []map[uint64][]int
+	vectors *floatMatrix
+	ids     []int
+	rows    map[int]int
+	nextID  int
+	random  *rand.Rand
+	ingest  *ingestOptions
+	mu      sync.RWMutex
+}
+
+// NewLSH 向外生产一个LSH索引，tables为哈希表个数，bits为每个表的哈希函数个数（不超过64），默认以当前时间为随机种子
+// 投影在第一次插入时按向量维度生成
+func NewLSH(tables int, bits int) *LSH {
+	if bits > 64 {
+		bits = 64
+	}
+	return &LSH{tables: tables, bits: bits, width: lshDefaultWidth, random: newTimeRand(), rows: make(map[int]int)}
+}
+
+// 设置随机种子，需在插入前设置，种子相同时生成的投影完全一致
+func (pointer *LSH) setSeed(seed int64) {
+	pointer.random = newRand(seed)
+}
+
+// 设置距离度量，需在插入前设置
+func (pointer *LSH) setMetric(m Metric) {
+	pointer.metric = m
+}
+
+// 设置L2度量下p稳定投影的桶宽，需在插入前设置，桶宽应与近邻间的距离同一量级
+func (pointer *LSH) setWidth(width float64) {
+	pointer.width = width
+}
+
+// 设置查找时每个表额外探测的相邻桶个数，相邻桶由翻转离边界最近的哈希值得到
+func (pointer *LSH) setProbes(probes int) {
+	pointer.probes = probes
+}
+
+// 读取csv数据时严格检查，按options报告或跳过格式错误、维度错误、非有限值与零向量
+func (pointer *LSH) useStrictIngest(options *ingestOptions) {
+	pointer.ingest = options
+}
+
+// 按维度分配各表的投影、偏移与空桶，投影的取值由调用者填充
+func (pointer *LSH) allocPlanes(dim int) {
+	pointer.planes = make([]*floatMatrix, pointer.tables)
+	pointer.offsets = make([][]float32, pointer.tables)
+	pointer.buckets = make([]map[uint64][]int, pointer.tables)
+	for t := 0; t < pointer.tables; t++ {
+		pointer.planes[t] = NewFloatMatrix(pointer.bits, dim)
+		pointer.offsets[t] = make([]float32, pointer.bits)
+		pointer.buckets[t] = make(map[uint64][]int)
+	}
+	pointer.vectors = NewFloatMatrix(0, dim)
+}
+
+// 按维度生成各表的投影，投影的每个分量服从标准正态分布
+func (pointer *LSH) initPlanes(dim int) {
+	if pointer.random == nil {
+		pointer.random = newTimeRand()
+	}
+	pointer.allocPlanes(dim)
+	for t := 0; t < pointer.tables; t++ {
+		for i := range pointer.planes[t].data {
+			pointer.planes[t].data[i] = float32(pointer.random.NormFloat64())
+		}
+		for i := range pointer.offsets[t] {
+			pointer.offsets[t][i] = float32(pointer.random.Float64() * pointer.width)
+		}
+	}
+}
+
+// 计算向量在第t个表中的各哈希值、离桶边界的距离与越过较近边界后的哈希值
+// 超平面哈希的取值为0或1，距离为投影的绝对值；p稳定哈希的取值为下取整的结果，距离为到较近边界的距离
+func (pointer *LSH) project(vector []float32, t int) (values []int64, margins []float64, neighbors []int64) {
+	projections := make([]float64, pointer.bits)
+	InnerProduct.scoreRows(vector, pointer.planes[t], nil, projections)
+	values = make([]int64, pointer.bits)
+	margins = make([]float64, pointer.bits)
+	neighbors = make([]int64, pointer.bits)
+	for i, projection := range projections {
+		if pointer.metric != L2 {
+			if projection >= 0 {
+				values[i] = 1
+			}
+			margins[i] = math.Abs(projection)
+			neighbors[i] = 1 - values[i]
+			continue
+		}
+		position := (projection + float64(pointer.offsets[t][i])) / pointer.width
+		floor := math.Floor(position)
+		values[i] = int64(floor)
+		if position-floor < 0.5 {
+			margins[i], neighbors[i] = (position-floor)*pointer.width, values[i]-1
+		} else {
+			margins[i], neighbors[i] = (floor+1-position)*pointer.width, values[i]+1
+		}
+	}
+	return values, margins, neighbors
+}
+
+// 由各哈希值得到桶号，超平面哈希按位拼接，p稳定哈希按多项式混合
+func (pointer *LSH) key(values []int64) uint64 {
+	var key uint64
+	for i, value := range values {
+		if pointer.metric != L2 {
+			key |= uint64(value) << uint(i)
+			continue
+		}
+		key = key*1099511628211 ^ uint64(value)
+	}
+	return key
+}
+
+// 查询向量在第t个表中要探测的桶号，第一个为所在的桶，其后为按离边界由近到远翻转一个哈希值得到的相邻桶
+func (pointer *LSH) probeKeys(vector []float32, t int) []uint64 {
+	values, margins, neighbors := pointer.project(vector, t)
+	keys := []uint64{pointer.key(values)}
+	if pointer.probes <= 0 {
+		return keys
+	}
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return margins[order[i]] < margins[order[j]]
+	})
+	for _, i := range order[:minInt(pointer.probes, len(order))] {
+		origin := values[i]
+		values[i] = neighbors[i]
+		keys = append(keys, pointer.key(values))
+		values[i] = origin
+	}
+	return keys
+}
+
+// 把第row行放入各表的桶中
+func (pointer *LSH) insertRow(row int) {
+	for t := 0; t < pointer.tables; t++ {
+		values, _, _ := pointer.project(pointer.vectors.row(row), t)
+		key := pointer.key(values)
+		pointer.buckets[t][key] = append(pointer.buckets[t][key], row)
+	}
+}
+
+// 在各表的桶中把行号from替换为to，to为-1时删除
+func (pointer *LSH) replaceRow(from int, to int) {
+	for t := 0; t < pointer.tables; t++ {
+		values, _, _ := pointer.project(pointer.vectors.row(from), t)
+		key := pointer.key(values)
+		bucket := pointer.buckets[t][key]
+		for i, row := range bucket {
+			if row != from {
+				continue
+			}
+			if to >= 0 {
+				bucket[i] = to
+				break
+			}
+			bucket[i] = bucket[len(bucket)-1]
+			bucket = bucket[:len(bucket)-1]
+			break
+		}
+		if len(bucket) == 0 {
+			delete(pointer.buckets[t], key)
+		} else {
+			pointer.buckets[t][key] = bucket
+		}
+	}
+}
+
+// 建立索引 path为csv数据路径, length为向量维度, 向量的外部编号从nextID起依次分配，删除后也不会与已有编号重复
+func (pointer *LSH) createIndex(path string, length int) error {
+	rows, err := loadDataWith(path, length, pointer.ingest)
+	if err != nil {
+		return err
+	}
+	pointer.mu.RLock()
+	start := pointer.nextID
+	pointer.mu.RUnlock()
+	for i := 0; i < rows.rows; i++ {
+		if err := pointer.Add(start+i, *rows.vectorAt(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add 插入一个向量，id为向量的外部编号，不能与已有编号重复，插入后立即可查
+func (pointer *LSH) Add(id int, vector floatVector) error {
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	if pointer.rows == nil {
+		pointer.rows = make(map[int]int)
+	}
+	if _, ok := pointer.rows[id]; ok {
+		return fmt.Errorf("编号%d已存在", id)
+	}
+	if pointer.planes == nil {
+		pointer.initPlanes(len(vector.vector))
+	}
+	if err := pointer.vectors.appendFloat64(vector.vector); err != nil {
+		return err
+	}
+	row := len(pointer.ids)
+	pointer.ids = append(pointer.ids, id)
+	pointer.rows[id] = row
+	if id >= pointer.nextID {
+		pointer.nextID = id + 1
+	}
+	pointer.insertRow(row)
+	return nil
+}
+
+// Delete 删除一个向量，最后一行移到被删除的位置，删除后立即不可查
+func (pointer *LSH) Delete(id int) error {
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	row, ok := pointer.rows[id]
+	if !ok {
+		return fmt.Errorf("编号%d不存在", id)
+	}
+	last := len(pointer.ids) - 1
+	pointer.replaceRow(row, -1)
+	if row != last {
+		pointer.replaceRow(last, row)
+		copy(pointer.vectors.row(row), pointer.vectors.row(last))
+		pointer.ids[row] = pointer.ids[last]
+		pointer.rows[pointer.ids[row]] = row
+	}
+	pointer.vectors.data = pointer.vectors.data[:last*pointer.vectors.dim]
+	pointer.vectors.rows--
+	pointer.ids = pointer.ids[:last]
+	delete(pointer.rows, id)
+	return nil
+}
+
+// 查找与输入向量最近的k个向量，返回结果的index为外部编号，distance为度量下的得分（越大越近），按由近到远排列
+// 只在各表探测到的桶内查找，与查询不同桶的向量不会被返回，结果可能少于k个
+func (pointer *LSH) searchVector(inputVector floatVector, k int) []searchResult {
+	pointer.mu.RLock()
+	defer pointer.mu.RUnlock()
+	nearest := &resultHeap{nearest: false}
+	if pointer.planes == nil {
+		return nearest.sorted()
+	}
+	if len(inputVector.vector) != pointer.vectors.dim {
+		fmt.Print("输入特征维度与索引维度不匹配")
+		return nil
+	}
+	query := toFloat32(inputVector.vector)
+	seen := make(map[int]bool)
+	for t := 0; t < pointer.tables; t++ {
+		for _, key := range pointer.probeKeys(query, t) {
+			for _, row := range pointer.buckets[t][key] {
+				if seen[row] {
+					continue
+				}
+				seen[row] = true
+				distance := pointer.metric.score32(query, pointer.vectors.row(row))
+				nearest.pushTop(searchResult{index: pointer.ids[row], distance: distance}, k)
+			}
+		}
+	}
+	return nearest.sorted()
+}
+
+// 存储索引，依次为魔数、版本、参数、各表的投影与偏移、向量个数与维度、每一行的外部编号与向量
+// 桶由投影在加载时重新计算
+func (pointer *LSH) storeIndex(path string) error {
+	pointer.mu.RLock()
+	defer pointer.mu.RUnlock()
+	outputFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	writer := bufio.NewWriter(outputFile)
+	dim := 0
+	if pointer.planes != nil {
+		dim = pointer.vectors.dim
+	}
+	header := []interface{}{
+		[]byte(lshMagic), uint32(lshVersion),
+		int64(pointer.tables), int64(pointer.bits), pointer.width, int64(pointer.probes), int64(pointer.metric),
+		int64(dim), int64(len(pointer.ids)),
+	}
+	for _, field := range header {
+		if err := binary.Write(writer, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	if dim > 0 {
+		for t := 0; t < pointer.tables; t++ {
+			if err := binary.Write(writer, binary.LittleEndian, pointer.planes[t].data); err != nil {
+				return err
+			}
+			if err := binary.Write(writer, binary.LittleEndian, pointer.offsets[t]); err != nil {
+				return err
+			}
+		}
+	}
+	for row, id := range pointer.ids {
+		if err := binary.Write(writer, binary.LittleEndian, int64(id)); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, pointer.vectors.row(row)); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// 加载storeIndex生成的索引，会清空已有的内容
+func (pointer *LSH) loadIndex(path string) error {
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	inputFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer inputFile.Close()
+	// 文件中读出的个数都不能超过文件大小所能容纳的个数，避免损坏的文件导致巨大的分配
+	info, err := inputFile.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	corrupt := errors.New("lsh索引文件已损坏")
+	reader := bufio.NewReader(inputFile)
+	magic := make([]byte, len(lshMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != lshMagic {
+		return errors.New("不是lsh索引文件")
+	}
+	var version uint32
+	if err := binary.Read(reader, binary.LittleEndian, &version); err != nil {
+		return err
+	}
+	if version != lshVersion {
+		return fmt.Errorf("lsh索引文件版本为%d, 当前只支持版本%d, 请重新建立索引", version, lshVersion)
+	}
+	var tables, bits, probes, metric, dim, length int64
+	var width float64
+	for _, field := range []interface{}{&tables, &bits, &width, &probes, &metric, &dim, &length} {
+		if err := binary.Read(reader, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	if tables <= 0 || bits <= 0 || bits > 64 || !(width > 0) || math.IsInf(width, 1) || probes < 0 {
+		return corrupt
+	}
+	// 每个表有bits行投影与bits个偏移，每一行有编号与向量
+	if dim < 0 || dim > size/4 || (length > 0 && dim == 0) || length < 0 || length > size/(8+4*dim) {
+		return corrupt
+	}
+	if dim > 0 && tables > size/(4*bits*(dim+1)) {
+		return corrupt
+	}
+	// 先读入局部变量，出错时不改动已有的内容；投影从文件读取，不使用随机数生成器
+	var planes []*floatMatrix
+	var offsets [][]float32
+	if dim > 0 {
+		planes, offsets = make([]*floatMatrix, tables), make([][]float32, tables)
+		for t := range planes {
+			planes[t], offsets[t] = NewFloatMatrix(int(bits), int(dim)), make([]float32, bits)
+			if err := binary.Read(reader, binary.LittleEndian, planes[t].data); err != nil {
+				return err
+			}
+			if err := binary.Read(reader, binary.LittleEndian, offsets[t]); err != nil {
+				return err
+			}
+		}
+	}
+	vectors := NewFloatMatrix(int(length), int(dim))
+	ids, rows, nextID := make([]int, 0, length), make(map[int]int, length), 0
+	for row := 0; row < int(length); row++ {
+		var id int64
+		if err := binary.Read(reader, binary.LittleEndian, &id); err != nil {
+			return err
+		}
+		if err := binary.Read(reader, binary.LittleEndian, vectors.row(row)); err != nil {
+			return err
+		}
+		if _, ok := rows[int(id)]; ok {
+			return corrupt
+		}
+		ids = append(ids, int(id))
+		rows[int(id)] = row
+		if int(id) >= nextID {
+			nextID = int(id) + 1
+		}
+	}
+	pointer.tables, pointer.bits, pointer.width = int(tables), int(bits), width
+	pointer.probes, pointer.metric = int(probes), Metric(metric)
+	pointer.planes, pointer.offsets, pointer.buckets, pointer.vectors = nil, nil, nil, nil
+	pointer.ids, pointer.rows, pointer.nextID = ids, rows, nextID
+	if dim == 0 {
+		return nil
+	}
+	pointer.planes, pointer.offsets, pointer.vectors = planes, offsets, vectors
+	pointer.buckets = make([]map[uint64][]int, tables)
+	for t := range pointer.buckets {
+		pointer.buckets[t] = make(map[uint64][]int)
+	}
+	for row := 0; row < int(length); row++ {
+		pointer.insertRow(row)
+	}
+	return nil
+}
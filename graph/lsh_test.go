@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// 删除后再次createIndex，新向量的编号不能与已有编号冲突
+func TestLSHCreateIndexAfterDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0.csv")
+	vectors := randomVectors(5, 4, 5)
+	writeVectorsCsv(t, path, vectors)
+	lsh := NewLSH(4, 6)
+	lsh.setSeed(5)
+	if err := lsh.createIndex(path, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsh.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsh.createIndex(path, 4); err != nil {
+		t.Fatal(err)
+	}
+	if len(lsh.ids) != 9 {
+		t.Fatalf("应有9个向量, 实际%d个", len(lsh.ids))
+	}
+	for id := 5; id < 10; id++ {
+		if _, ok := lsh.rows[id]; !ok {
+			t.Fatalf("第二次载入的向量缺少编号%d", id)
+		}
+	}
+	if result := lsh.searchVector(vectors[1], 1); len(result) == 0 || result[0].index != 6 {
+		t.Fatalf("重新载入的向量查不到: %v", result)
+	}
+}
+
+// 保存后载入到零值的LSH，查询结果与原索引相同，编号分配也延续下去
+func TestLSHStoreLoad(t *testing.T) {
+	vectors := randomVectors(300, 8, 6)
+	lsh := NewLSH(6, 8)
+	lsh.setSeed(6)
+	lsh.setMetric(L2)
+	lsh.setProbes(2)
+	for i, vector := range vectors {
+		if err := lsh.Add(i, vector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < len(vectors); i += 4 {
+		lsh.Delete(i)
+	}
+	path := filepath.Join(t.TempDir(), "lsh.bin")
+	if err := lsh.storeIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &LSH{}
+	if err := loaded.loadIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.ids) != len(lsh.ids) || loaded.nextID != lsh.nextID {
+		t.Fatalf("载入的向量数%d或下一个编号%d与原索引不同", len(loaded.ids), loaded.nextID)
+	}
+	for i := 1; i < len(vectors); i += 9 {
+		want := lsh.searchVector(vectors[i], 5)
+		got := loaded.searchVector(vectors[i], 5)
+		if len(want) != len(got) {
+			t.Fatalf("查询%d的结果个数不同", i)
+		}
+		for j := range want {
+			if want[j] != got[j] {
+				t.Fatalf("查询%d的第%d个结果不同: %v, %v", i, j, want[j], got[j])
+			}
+		}
+	}
+}
+
+// 损坏的索引文件返回错误而不是崩溃或巨大的分配，已有的内容保持不变
+func TestLSHLoadCorrupt(t *testing.T) {
+	lsh := NewLSH(4, 8)
+	lsh.setSeed(7)
+	for i, vector := range randomVectors(50, 4, 7) {
+		lsh.Add(i, vector)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lsh.bin")
+	if err := lsh.storeIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 魔数与版本号之后依次为表个数、哈希函数个数、桶宽、探测个数、度量、维度与向量个数
+	const tablesOffset, bitsOffset, dimOffset, lengthOffset = 8, 16, 48, 56
+	if binary.LittleEndian.Uint64(content[lengthOffset:]) != 50 {
+		t.Fatal("向量个数的位置与文件格式不符")
+	}
+	cases := []struct {
+		offset int
+		value  int64
+	}{
+		{tablesOffset, 0}, {tablesOffset, 1 << 40}, {bitsOffset, 65}, {bitsOffset, -1},
+		{dimOffset, -1}, {dimOffset, 1 << 40}, {lengthOffset, -1}, {lengthOffset, 1 << 40},
+	}
+	for _, item := range cases {
+		broken := append([]byte(nil), content...)
+		binary.LittleEndian.PutUint64(broken[item.offset:], uint64(item.value))
+		brokenPath := filepath.Join(dir, "broken.bin")
+		if err := ioutil.WriteFile(brokenPath, broken, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := lsh.loadIndex(brokenPath); err == nil {
+			t.Fatalf("第%d字节处的值为%d时应返回错误", item.offset, item.value)
+		}
+		if len(lsh.ids) != 50 || lsh.tables != 4 || lsh.bits != 8 {
+			t.Fatalf("加载失败后已有的内容被改动: %d个向量, %d个表, %d位", len(lsh.ids), lsh.tables, lsh.bits)
+		}
+	}
+}
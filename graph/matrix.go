@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// floatMatrix 行优先连续存储的float32矩阵，每一行为一个向量，rows为行数，dim为向量维度
+// 与floatVectors相比内存减半且连续，用于索引内部存储大量向量
+type floatMatrix struct {
+	data []float32
+	rows int
+	dim  int
+}
+
+// NewFloatMatrix 向外生产一个rows行dim列的矩阵
+func NewFloatMatrix(rows int, dim int) *floatMatrix {
+	return &floatMatrix{data: make([]float32, rows*dim), rows: rows, dim: dim}
+}
+
+// 返回第i行，与矩阵共享内存
+func (pointer *floatMatrix) row(i int) []float32 {
+	return pointer.data[i*pointer.dim : (i+1)*pointer.dim : (i+1)*pointer.dim]
+}
+
+// 返回第start行到第end行（不含）组成的子矩阵，与矩阵共享内存
+func (pointer *floatMatrix) rowRange(start int, end int) *floatMatrix {
+	return &floatMatrix{data: pointer.data[start*pointer.dim : end*pointer.dim : end*pointer.dim], rows: end - start, dim: pointer.dim}
+}
+
+// 在末尾增加一行
+func (pointer *floatMatrix) appendRow(input []float32) error {
+	if len(input) != pointer.dim {
+		return errors.New("输入特征维度与初始化维度不匹配")
+	}
+	pointer.data = append(pointer.data, input...)
+	pointer.rows++
+	return nil
+}
+
+// 在末尾增加一行float64向量
+func (pointer *floatMatrix) appendFloat64(input []float64) error {
+	if len(input) != pointer.dim {
+		return errors.New("输入特征维度与初始化维度不匹配")
+	}
+	for _, value := range input {
+		pointer.data = append(pointer.data, float32(value))
+	}
+	pointer.rows++
+	return nil
+}
+
+// 在末尾增加另一个矩阵的所有行
+func (pointer *floatMatrix) appendMatrix(input *floatMatrix) error {
+	if input.dim != pointer.dim {
+		return errors.New("输入特征维度与初始化维度不匹配")
+	}
+	pointer.data = append(pointer.data, input.data...)
+	pointer.rows += input.rows
+	return nil
+}
+
+// 设置第i行
+func (pointer *floatMatrix) setRow(i int, input []float64) error {
+	if len(input) != pointer.dim {
+		return errors.New("输入特征维度与初始化维度不匹配")
+	}
+	row := pointer.row(i)
+	for j, value := range input {
+		row[j] = float32(value)
+	}
+	return nil
+}
+
+// 取出每一行第start列到第end列（不含），复制成新矩阵，用于pq分段
+func (pointer *floatMatrix) cutColumns(start int, end int) *floatMatrix {
+	result := NewFloatMatrix(pointer.rows, end-start)
+	for i := 0; i < pointer.rows; i++ {
+		copy(result.row(i), pointer.row(i)[start:end])
+	}
+	return result
+}
+
+// 把第i行转化为floatVector
+func (pointer *floatMatrix) vectorAt(i int) *floatVector {
+	vector := NewFloatVector(pointer.dim)
+	for j, value := range pointer.row(i) {
+		vector.vector[j] = float64(value)
+	}
+	return vector
+}
+
+// 返回第i行的string
+func (pointer *floatMatrix) rowString(i int) []string {
+	row := pointer.row(i)
+	strings := make([]string, pointer.dim)
+	for j, value := range row {
+		strings[j] = strconv.FormatFloat(float64(value), 'f', -1, 32)
+	}
+	return strings
+}
+
+// 把float64向量转化为float32
+func toFloat32(input []float64) []float32 {
+	result := make([]float32, len(input))
+	for i, value := range input {
+		result[i] = float32(value)
+	}
+	return result
+}
+
+// 把一组floatVector转化为矩阵
+func vectorsToMatrix(vectors []floatVector) (*floatMatrix, error) {
+	if len(vectors) == 0 {
+		return NewFloatMatrix(0, 0), nil
+	}
+	result := NewFloatMatrix(0, vectors[0].length)
+	result.data = make([]float32, 0, len(vectors)*vectors[0].length)
+	for _, vector := range vectors {
+		if err := result.appendFloat64(vector.vector); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Metric 距离度量。所有索引都按得分比较远近，得分越大越近：
+// 内积直接返回内积，余弦返回夹角余弦，L2返回欧氏距离平方的相反数
+type Metric int
+
+const (
+	// InnerProduct 内积，为各索引的默认度量
+	InnerProduct Metric = iota
+	// Cosine 余弦相似度
+	Cosine
+	// L2 欧氏距离
+	L2
+)
+
+// 返回度量的名称
+func (m Metric) String() string {
+	switch m {
+	case InnerProduct:
+		return "ip"
+	case Cosine:
+		return "cosine"
+	case L2:
+		return "l2"
+	}
+	return fmt.Sprintf("Metric(%d)", int(m))
+}
+
+// 计算两个等长向量的得分，得分越大越近；余弦度量下零向量的得分为0
+func (m Metric) score(a []float64, b []float64) float64 {
+	switch m {
+	case Cosine:
+		var dot, normA, normB float64
+		for i := range a {
+			dot += a[i] * b[i]
+			normA += a[i] * a[i]
+			normB += b[i] * b[i]
+		}
+		if normA == 0 || normB == 0 {
+			return 0
+		}
+		return dot / math.Sqrt(normA*normB)
+	case L2:
+		var sum float64
+		for i := range a {
+			diff := a[i] - b[i]
+			sum += diff * diff
+		}
+		return -sum
+	}
+	var dot float64
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return dot
+}
+
+// 计算两个等长float32向量的得分，规则与score相同
+func (m Metric) score32(a []float32, b []float32) float64 {
+	switch m {
+	case Cosine:
+		var dot, normA, normB float32
+		for i := range a {
+			dot += a[i] * b[i]
+			normA += a[i] * a[i]
+			normB += b[i] * b[i]
+		}
+		if normA == 0 || normB == 0 {
+			return 0
+		}
+		return float64(dot) / math.Sqrt(float64(normA)*float64(normB))
+	case L2:
+		var sum float32
+		for i := range a {
+			diff := a[i] - b[i]
+			sum += diff * diff
+		}
+		return -float64(sum)
+	}
+	var dot float32
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return float64(dot)
+}
+
+// 更新聚簇中心：sum为簇内向量之和，count为簇内向量个数，结果写入center。
+// 内积与L2取均值，余弦取均值后再归一化（球面kmeans）
+func (m Metric) updateCenter(center []float32, sum []float64, count int) error {
+	if count == 0 {
+		return errors.New("除数为零")
+	}
+	scale := 1 / float64(count)
+	if m == Cosine {
+		var module float64
+		for _, value := range sum {
+			module += value * value
+		}
+		if module == 0 {
+			return errors.New("存在模为0的向量")
+		}
+		scale = 1 / math.Sqrt(module)
+	}
+	for i, value := range sum {
+		center[i] = float32(value * scale)
+	}
+	return nil
+}
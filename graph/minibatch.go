@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// 小批量模式下每个聚心对应的初始采样点个数与默认最大轮数
+const (
+	miniBatchSampling = 4
+	miniBatchEpochs   = 10
+)
+
+// 返回小批量模式的最大轮数，未设置时为默认值
+func (pointer *Kmeans) maxEpochs() int {
+	if pointer.epochs <= 0 {
+		return miniBatchEpochs
+	}
+	return pointer.epochs
+}
+
+// 小批量k-means 在采样点上选取初始中心，之后每轮按随机顺序逐个读取数据文件，把文件内的向量打乱后
+// 切成batchSize大小的批次依次更新聚心，内存中只保留一个文件与聚心。每轮结束时按设置重新选取本轮没有分到点的聚心
+// files为数据目录下的文件名，结果写入pointer.center与pointer.report
+func (pointer *Kmeans) miniBatchCenter(dataPath string, files []string, length int, num int) error {
+	if pointer.center != nil {
+		return fmt.Errorf("中心数据已产生，无需搜索")
+	}
+	if pointer.vectors.rows < num {
+		return fmt.Errorf("采样点个数%d少于聚簇点个数%d", pointer.vectors.rows, num)
+	}
+	start := time.Now()
+	m := pointer.metric
+	center := initCenter(pointer.vectors, num, pointer.random, m, pointer.options)
+	previous := NewFloatMatrix(num, center.dim)
+	copy(previous.data, center.data)
+	// total为每个聚心累计分到的点数，学习率为其倒数
+	total := make([]int, num)
+	// reseededBefore标记之前各轮重新选取过的聚心
+	reseededBefore := make([]bool, num)
+	report := &kmeansReport{inertia: make([]float64, 0)}
+	for epoch := 0; epoch < pointer.maxEpochs(); epoch++ {
+		var inertia float64
+		sizes := make([]int, num)
+		var last *floatMatrix
+		var lastNeighbor []int
+		var lastScores []float64
+		for _, index := range pointer.random.Perm(len(files)) {
+			rows, err := loadDataWith(dataPath+"/"+files[index], length, pointer.ingest)
+			if err != nil {
+				return err
+			}
+			rows, err = pointer.pca.applyMatrix(rows)
+			if err != nil {
+				return err
+			}
+			order := pointer.random.Perm(rows.rows)
+			for begin := 0; begin < len(order); begin += pointer.batchSize {
+				batch := NewFloatMatrix(0, center.dim)
+				for _, row := range order[begin:minInt(begin+pointer.batchSize, len(order))] {
+					batch.appendRow(rows.row(row))
+				}
+				neighbor, scores := miniBatchStep(center, batch, total, m)
+				inertia += inertiaOf(scores, m)
+				for _, neigh := range neighbor {
+					sizes[neigh]++
+				}
+				last, lastNeighbor, lastScores = batch, neighbor, scores
+			}
+		}
+		report.inertia = append(report.inertia, inertia)
+		report.iterations = epoch + 1
+		report.sizes = sizes
+		if last == nil {
+			break
+		}
+		// 用最后一批的点重新选取本轮失效的聚心，重新选取的聚心从头开始累计学习率
+		dead := make([]bool, num)
+		count := make([]int, num)
+		for _, neigh := range lastNeighbor {
+			count[neigh]++
+		}
+		for j, size := range sizes {
+			dead[j] = size == 0
+		}
+		reseeded := reseedCenters(center, last, dead, count, lastNeighbor, lastScores, m, pointer.options.reseed)
+		blocking := blockingReseeds(reseeded, reseededBefore)
+		report.reseeded += len(reseeded)
+		for j, isDead := range dead {
+			if isDead {
+				total[j] = count[j]
+			}
+		}
+		fmt.Printf("小批量k-means第%d轮, 代价%f\n", epoch, inertia)
+		var shift float64
+		for j := 0; j < num; j++ {
+			shift = math.Max(shift, -L2.score32(previous.row(j), center.row(j)))
+		}
+		copy(previous.data, center.data)
+		if blocking == 0 && epoch > 0 && pointer.options.converged(report.inertia[epoch-1], inertia, math.Sqrt(shift)) {
+			report.converged = true
+			break
+		}
+	}
+	report.elapsed = time.Since(start)
+	fmt.Printf("聚心0%s\n", report)
+	pointer.center, pointer.report = center, report
+	return nil
+}
+
+// 用一批点更新聚心：每个点分给最近的聚心，聚心向该点移动，学习率为聚心累计分到点数的倒数
+// 不同聚心的更新互不影响，按聚心并行，同一聚心按批内顺序更新；余弦度量下更新后归一化
+// 返回批内每个点所属的聚心与得分
+func miniBatchStep(center *floatMatrix, batch *floatMatrix, total []int, m Metric) ([]int, []float64) {
+	neighbor, scores := nearestRows(batch, center, m)
+	members := make([][]int, center.rows)
+	for i, neigh := range neighbor {
+		members[neigh] = append(members[neigh], i)
+	}
+	parallelFor(center.rows, func(j int) {
+		if len(members[j]) == 0 {
+			return
+		}
+		row := center.row(j)
+		for _, i := range members[j] {
+			total[j]++
+			rate := 1 / float32(total[j])
+			for k, value := range batch.row(i) {
+				row[k] += rate * (value - row[k])
+			}
+		}
+		if m == Cosine {
+			if module := math.Sqrt(float64(dot32(row, row))); module > 0 {
+				for k := range row {
+					row[k] = float32(float64(row[k]) / module)
+				}
+			}
+		}
+	})
+	return neighbor, scores
+}
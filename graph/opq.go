@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+)
+
+// opq每轮交替中码本的k-means最大迭代次数，码本在各轮之间延续，因此每轮只需少量迭代
+const opqKmeansIterations = 10
+
+// 旋转矩阵的第i行为旋转后第i维的系数，即y = R*x
+// 把矩阵的每一行旋转，得到新的矩阵
+func rotateRows(rotation *floatMatrix, rows *floatMatrix) *floatMatrix {
+	if rotation == nil {
+		return rows
+	}
+	result := NewFloatMatrix(rows.rows, rotation.rows)
+	out := make([]float64, rows.rows*rotation.rows)
+	InnerProduct.scoreBlock(rows, nil, rotation, nil, out)
+	for i, value := range out {
+		result.data[i] = float32(value)
+	}
+	return result
+}
+
+// 旋转一个向量
+func rotateVector(rotation *floatMatrix, vector []float64) []float64 {
+	if rotation == nil {
+		return vector
+	}
+	input := toFloat32(vector)
+	result := make([]float64, rotation.rows)
+	for i := range result {
+		result[i] = float64(dot32(rotation.row(i), input))
+	}
+	return result
+}
+
+// 学习OPQ旋转矩阵 samples为训练样本，M为量化分段个数，pqNum为每段的码本大小，iterations为交替的轮数
+// options为码本的训练设置，决定初始码本的选取方式。每轮先在旋转后的样本上训练各段码本并编码重建，再固定重建结果求使重建误差最小的正交矩阵（正交Procrustes问题）
+func trainRotation(samples *floatMatrix, M int, pqNum int, iterations int, random *rand.Rand, options kmeansOptions) *floatMatrix {
+	D := samples.dim
+	dim := D / M
+	rotation := NewFloatMatrix(D, D)
+	for i := 0; i < D; i++ {
+		rotation.row(i)[i] = 1
+	}
+	codebooks := make([]*floatMatrix, M)
+	refineOptions := options
+	refineOptions.maxIterations = minInt(options.iterations(), opqKmeansIterations)
+	for iteration := 0; iteration < iterations; iteration++ {
+		rotated := rotateRows(rotation, samples)
+		// 训练码本并重建
+		reconstructed := NewFloatMatrix(samples.rows, D)
+		var loss float64
+		for k := 0; k < M; k++ {
+			segment := rotated.cutColumns(k*dim, (k+1)*dim)
+			if codebooks[k] == nil {
+				codebooks[k] = initCenter(segment, pqNum, random, L2, options)
+			}
+			refineCenter(codebooks[k], segment, k, L2, refineOptions)
+			codes, distances := nearestRows(segment, codebooks[k], L2)
+			for i, code := range codes {
+				copy(reconstructed.row(i)[k*dim:(k+1)*dim], codebooks[k].row(code))
+				loss -= distances[i]
+			}
+		}
+		fmt.Printf("opq第%d轮, 平均量化误差%f\n", iteration, loss/float64(samples.rows))
+		// 求R使sum||R*x - y||^2最小，其中y为重建结果：令C = sum x*y^T = U*S*V^T，则R = V*U^T
+		C := make([][]float64, D)
+		for a := range C {
+			C[a] = make([]float64, D)
+		}
+		parallelFor(D, func(a int) {
+			for i := 0; i < samples.rows; i++ {
+				x := float64(samples.row(i)[a])
+				if x == 0 {
+					continue
+				}
+				for b, y := range reconstructed.row(i) {
+					C[a][b] += x * float64(y)
+				}
+			}
+		})
+		rotation = procrustes(C)
+	}
+	return rotation
+}
+
+// 求正交矩阵R使tr(R*C)最大：C = U*S*V^T时R = V*U^T
+// 由C^T*C = V*S^2*V^T求出V与S，再由U = C*V*S^-1求出U
+func procrustes(C [][]float64) *floatMatrix {
+	D := len(C)
+	CtC := make([][]float64, D)
+	for a := range CtC {
+		CtC[a] = make([]float64, D)
+	}
+	parallelFor(D, func(a int) {
+		for b := a; b < D; b++ {
+			var sum float64
+			for r := 0; r < D; r++ {
+				sum += C[r][a] * C[r][b]
+			}
+			CtC[a][b] = sum
+		}
+	})
+	for a := 0; a < D; a++ {
+		for b := 0; b < a; b++ {
+			CtC[a][b] = CtC[b][a]
+		}
+	}
+	values, V := jacobiEigen(CtC)
+	// U的第e列为C*v_e/s_e，奇异值为0的列由正交化补全
+	U := make([][]float64, D)
+	for e := 0; e < D; e++ {
+		U[e] = make([]float64, D)
+		s := math.Sqrt(math.Max(values[e], 0))
+		if s == 0 {
+			continue
+		}
+		for r := 0; r < D; r++ {
+			var sum float64
+			for b := 0; b < D; b++ {
+				sum += C[r][b] * V[b][e]
+			}
+			U[e][r] = sum / s
+		}
+	}
+	completeOrthonormal(U)
+	rotation := NewFloatMatrix(D, D)
+	for a := 0; a < D; a++ {
+		row := rotation.row(a)
+		for b := 0; b < D; b++ {
+			var sum float64
+			for e := 0; e < D; e++ {
+				sum += V[a][e] * U[e][b]
+			}
+			row[b] = float32(sum)
+		}
+	}
+	return rotation
+}
+
+// 把一组向量正交单位化，与前面的向量线性相关的向量用标准基补全，保证结果为一组正交基
+func completeOrthonormal(vectors [][]float64) {
+	orthonormalize(vectors)
+	for i, vector := range vectors {
+		if dot64(vector, vector) > 0.5 {
+			continue
+		}
+		for basis := range vector {
+			for k := range vector {
+				vector[k] = 0
+			}
+			vector[basis] = 1
+			for j := range vectors {
+				if j == i || dot64(vectors[j], vectors[j]) < 0.5 {
+					continue
+				}
+				projection := dot64(vector, vectors[j])
+				for k := range vector {
+					vector[k] -= projection * vectors[j][k]
+				}
+			}
+			norm := math.Sqrt(dot64(vector, vector))
+			if norm > 1e-6 {
+				for k := range vector {
+					vector[k] /= norm
+				}
+				break
+			}
+		}
+	}
+}
+
+// 存储旋转矩阵 每行第一列为行号，与聚心文件格式相同
+func storeRotation(path string, rotation *floatMatrix) error {
+	outputFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	outputWriter := csv.NewWriter(outputFile)
+	for i := 0; i < rotation.rows; i++ {
+		outputWriter.Write(append([]string{strconv.Itoa(i)}, rotation.rowString(i)...))
+	}
+	outputWriter.Flush()
+	return outputWriter.Error()
+}
+
+// 载入旋转矩阵 length为向量维度，文件不存在表示没有使用OPQ，返回nil
+func loadRotation(path string, length int) *floatMatrix {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return loadCenter(path, length)
+}
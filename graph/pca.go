@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// pca变换文件的魔数与版本号，文件格式改变时需要增加版本号
+const (
+	pcaMagic   = "PCAT"
+	pcaVersion = 1
+	// 建立降维变换时最多使用的采样点个数
+	pcaSampling = 65536
+	// 子空间迭代的次数与多取的维度个数，多取的维度可以加快收敛
+	pcaIterations = 20
+	pcaOversample = 10
+	// 白化时加在特征值上的小量，避免除以0
+	pcaEpsilon = 1e-9
+)
+
+// PCA 主成分分析降维变换，放在索引之前，建立索引的数据与查询向量都先经过它
+// inputDim为输入维度, outputDim为降维后的维度, whiten表示是否白化（各主成分除以其标准差）
+// mean为训练样本的均值, components为outputDim行inputDim列的主成分（行优先）, eigenvalues为各主成分的方差
+type PCA struct {
+	inputDim    int
+	outputDim   int
+	whiten      bool
+	mean        []float64
+	components  []float64
+	eigenvalues []float64
+}
+
+// NewPCA 向外生产一个降维到outputDim维的PCA变换，需训练后使用
+func NewPCA(outputDim int, whiten bool) *PCA {
+	return &PCA{outputDim: outputDim, whiten: whiten}
+}
+
+// 是否已训练
+func (pointer *PCA) trained() bool {
+	return pointer != nil && pointer.mean != nil
+}
+
+// 经过变换后的维度，没有变换时为length
+func (pointer *PCA) dim(length int) int {
+	if pointer == nil {
+		return length
+	}
+	return pointer.outputDim
+}
+
+// 在采样点上训练变换 vectors的每一行为一个采样点，random用于子空间迭代的初始化
+// 先求协方差矩阵，再用子空间迭代求前outputDim个主成分
+func (pointer *PCA) train(vectors *floatMatrix, random *rand.Rand) error {
+	d, n := vectors.dim, vectors.rows
+	if pointer.outputDim <= 0 || pointer.outputDim > d {
+		return fmt.Errorf("降维后的维度%d需在1到%d之间", pointer.outputDim, d)
+	}
+	if n < 2 {
+		return errors.New("训练降维变换的采样点过少")
+	}
+	mean := make([]float64, d)
+	for i := 0; i < n; i++ {
+		for j, value := range vectors.row(i) {
+			mean[j] += float64(value)
+		}
+	}
+	for j := range mean {
+		mean[j] /= float64(n)
+	}
+	// 转置后的中心化数据，第j行为所有采样点在第j维的取值，使协方差的每一项都是两行的内积
+	columns := make([][]float64, d)
+	for j := range columns {
+		columns[j] = make([]float64, n)
+	}
+	for i := 0; i < n; i++ {
+		for j, value := range vectors.row(i) {
+			columns[j][i] = float64(value) - mean[j]
+		}
+	}
+	cov := make([][]float64, d)
+	for i := range cov {
+		cov[i] = make([]float64, d)
+	}
+	parallelFor(d, func(i int) {
+		for j := i; j < d; j++ {
+			var sum float64
+			for r, value := range columns[i] {
+				sum += value * columns[j][r]
+			}
+			cov[i][j] = sum / float64(n-1)
+		}
+	})
+	for i := 0; i < d; i++ {
+		for j := 0; j < i; j++ {
+			cov[i][j] = cov[j][i]
+		}
+	}
+	// 子空间迭代：Q <- orth(C*Q)
+	p := minInt(pointer.outputDim+pcaOversample, d)
+	Q := make([][]float64, p)
+	for c := range Q {
+		Q[c] = make([]float64, d)
+		for j := range Q[c] {
+			Q[c][j] = random.NormFloat64()
+		}
+	}
+	orthonormalize(Q)
+	for iteration := 0; iteration < pcaIterations; iteration++ {
+		Z := make([][]float64, p)
+		parallelFor(p, func(c int) {
+			Z[c] = matVec(cov, Q[c])
+		})
+		Q = Z
+		orthonormalize(Q)
+	}
+	// 在子空间内求投影矩阵T = Q^T C Q的特征分解，得到主成分与方差
+	CQ := make([][]float64, p)
+	parallelFor(p, func(c int) {
+		CQ[c] = matVec(cov, Q[c])
+	})
+	T := make([][]float64, p)
+	for a := range T {
+		T[a] = make([]float64, p)
+		for b := range T[a] {
+			T[a][b] = dot64(Q[a], CQ[b])
+		}
+	}
+	values, vecs := jacobiEigen(T)
+	order := make([]int, p)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return values[order[a]] > values[order[b]]
+	})
+	components := make([]float64, pointer.outputDim*d)
+	eigenvalues := make([]float64, pointer.outputDim)
+	for i := 0; i < pointer.outputDim; i++ {
+		e := order[i]
+		eigenvalues[i] = math.Max(values[e], 0)
+		component := components[i*d : (i+1)*d]
+		for c := 0; c < p; c++ {
+			weight := vecs[c][e]
+			for j, value := range Q[c] {
+				component[j] += weight * value
+			}
+		}
+	}
+	pointer.inputDim, pointer.mean, pointer.components, pointer.eigenvalues = d, mean, components, eigenvalues
+	return nil
+}
+
+// 变换一个向量，没有变换时原样返回
+func (pointer *PCA) apply(vector []float64) []float64 {
+	if pointer == nil {
+		return vector
+	}
+	centered := make([]float64, pointer.inputDim)
+	for j := range centered {
+		centered[j] = vector[j] - pointer.mean[j]
+	}
+	result := make([]float64, pointer.outputDim)
+	for i := range result {
+		result[i] = dot64(pointer.components[i*pointer.inputDim:(i+1)*pointer.inputDim], centered)
+		if pointer.whiten {
+			result[i] /= math.Sqrt(pointer.eigenvalues[i] + pcaEpsilon)
+		}
+	}
+	return result
+}
+
+// 变换一个floatVector，维度不匹配时返回错误
+func (pointer *PCA) applyVector(vector floatVector) (floatVector, error) {
+	if pointer == nil {
+		return vector, nil
+	}
+	if !pointer.trained() {
+		return vector, errors.New("降维变换尚未训练")
+	}
+	if vector.length != pointer.inputDim {
+		return vector, errors.New("输入特征维度与降维变换维度不匹配")
+	}
+	result := NewFloatVector(pointer.outputDim)
+	result.SetVector(pointer.apply(vector.vector))
+	return *result, nil
+}
+
+// 变换矩阵的每一行，得到新的矩阵，没有变换时原样返回
+func (pointer *PCA) applyMatrix(vectors *floatMatrix) (*floatMatrix, error) {
+	if pointer == nil {
+		return vectors, nil
+	}
+	if !pointer.trained() {
+		return nil, errors.New("降维变换尚未训练")
+	}
+	if vectors.dim != pointer.inputDim {
+		return nil, errors.New("输入特征维度与降维变换维度不匹配")
+	}
+	result := NewFloatMatrix(vectors.rows, pointer.outputDim)
+	parallelFor(vectors.rows, func(i int) {
+		input := make([]float64, vectors.dim)
+		for j, value := range vectors.row(i) {
+			input[j] = float64(value)
+		}
+		result.setRow(i, pointer.apply(input))
+	})
+	return result, nil
+}
+
+// 尚未训练时先从vectors中随机抽取最多pcaSampling行训练变换，再变换vectors的每一行
+func (pointer *PCA) fitApply(vectors *floatMatrix, random *rand.Rand) (*floatMatrix, error) {
+	if pointer == nil {
+		return vectors, nil
+	}
+	if !pointer.trained() {
+		sample := vectors
+		if vectors.rows > pcaSampling {
+			sample = NewFloatMatrix(0, vectors.dim)
+			for _, index := range random.Perm(vectors.rows)[:pcaSampling] {
+				sample.appendRow(vectors.row(index))
+			}
+		}
+		if err := pointer.train(sample, random); err != nil {
+			return nil, err
+		}
+	}
+	return pointer.applyMatrix(vectors)
+}
+
+// 把变换写入writer，格式为魔数与版本号、输入输出维度、白化标记、均值、主成分与方差
+func (pointer *PCA) writeTo(writer io.Writer) error {
+	fields := []interface{}{
+		[]byte(pcaMagic), uint32(pcaVersion),
+		int64(pointer.inputDim), int64(pointer.outputDim), pointer.whiten,
+		pointer.mean, pointer.components, pointer.eigenvalues,
+	}
+	for _, field := range fields {
+		if err := binary.Write(writer, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 从reader读入writeTo写出的变换
+func (pointer *PCA) readFrom(reader io.Reader) error {
+	magic := make([]byte, len(pcaMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != pcaMagic {
+		return errors.New("不是pca变换文件")
+	}
+	var version uint32
+	if err := binary.Read(reader, binary.LittleEndian, &version); err != nil {
+		return err
+	}
+	if version != pcaVersion {
+		return fmt.Errorf("pca变换文件版本为%d, 当前只支持版本%d", version, pcaVersion)
+	}
+	var inputDim, outputDim int64
+	var whiten bool
+	for _, field := range []interface{}{&inputDim, &outputDim, &whiten} {
+		if err := binary.Read(reader, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	if inputDim <= 0 || outputDim <= 0 || outputDim > inputDim {
+		return errors.New("pca变换文件已损坏")
+	}
+	mean := make([]float64, inputDim)
+	components := make([]float64, outputDim*inputDim)
+	eigenvalues := make([]float64, outputDim)
+	for _, field := range []interface{}{mean, components, eigenvalues} {
+		if err := binary.Read(reader, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	pointer.inputDim, pointer.outputDim, pointer.whiten = int(inputDim), int(outputDim), whiten
+	pointer.mean, pointer.components, pointer.eigenvalues = mean, components, eigenvalues
+	return nil
+}
+
+// 存储变换 path为文件路径
+func (pointer *PCA) storeTransform(path string) error {
+	outputFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	writer := bufio.NewWriter(outputFile)
+	if err := pointer.writeTo(writer); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// 加载storeTransform生成的变换文件
+func loadTransform(path string) (*PCA, error) {
+	inputFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer inputFile.Close()
+	pca := &PCA{}
+	if err := pca.readFrom(bufio.NewReader(inputFile)); err != nil {
+		return nil, err
+	}
+	return pca, nil
+}
+
+// 索引的降维变换尚未训练时从path加载，文件不存在表示建立索引时没有使用降维，返回nil
+func loadTransformIfExist(pca *PCA, path string) *PCA {
+	if pca.trained() {
+		return pca
+	}
+	loaded, err := loadTransform(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		fmt.Print(err)
+		return pca
+	}
+	return loaded
+}
+
+// 两个等长float64向量的内积
+func dot64(a []float64, b []float64) float64 {
+	var sum float64
+	for i, value := range a {
+		sum += value * b[i]
+	}
+	return sum
+}
+
+// 方阵与向量相乘
+func matVec(matrix [][]float64, vector []float64) []float64 {
+	result := make([]float64, len(matrix))
+	for i, row := range matrix {
+		result[i] = dot64(row, vector)
+	}
+	return result
+}
+
+// 用修正的Gram-Schmidt方法把一组向量正交单位化，线性相关的向量置为0
+func orthonormalize(vectors [][]float64) {
+	for i, vector := range vectors {
+		for j := 0; j < i; j++ {
+			projection := dot64(vector, vectors[j])
+			for k := range vector {
+				vector[k] -= projection * vectors[j][k]
+			}
+		}
+		norm := math.Sqrt(dot64(vector, vector))
+		for k := range vector {
+			if norm > 0 {
+				vector[k] /= norm
+			} else {
+				vector[k] = 0
+			}
+		}
+	}
+}
+
+// 用循环Jacobi方法求对称矩阵的特征值与特征向量，a会被修改
+// 返回的vectors[i][e]为第e个特征向量的第i个分量
+func jacobiEigen(a [][]float64) (values []float64, vectors [][]float64) {
+	n := len(a)
+	vectors = make([][]float64, n)
+	for i := range vectors {
+		vectors[i] = make([]float64, n)
+		vectors[i][i] = 1
+	}
+	for sweep := 0; sweep < 100; sweep++ {
+		var off, total float64
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				total += a[i][j] * a[i][j]
+				if i != j {
+					off += a[i][j] * a[i][j]
+				}
+			}
+		}
+		if off <= 1e-24*total || off == 0 {
+			break
+		}
+		for p := 0; p < n; p++ {
+			for q := p + 1; q < n; q++ {
+				if a[p][q] == 0 {
+					continue
+				}
+				// 选取旋转角使a[p][q]变为0
+				theta := (a[q][q] - a[p][p]) / (2 * a[p][q])
+				t := 1 / (math.Abs(theta) + math.Sqrt(theta*theta+1))
+				if theta < 0 {
+					t = -t
+				}
+				c := 1 / math.Sqrt(t*t+1)
+				s := t * c
+				for k := 0; k < n; k++ {
+					akp, akq := a[k][p], a[k][q]
+					a[k][p], a[k][q] = c*akp-s*akq, s*akp+c*akq
+				}
+				for k := 0; k < n; k++ {
+					apk, aqk := a[p][k], a[q][k]
+					a[p][k], a[q][k] = c*apk-s*aqk, s*apk+c*aqk
+				}
+				for k := 0; k < n; k++ {
+					vkp, vkq := vectors[k][p], vectors[k][q]
+					vectors[k][p], vectors[k][q] = c*vkp-s*vkq, s*vkp+c*vkq
+				}
+			}
+		}
+	}
+	values = make([]float64, n)
+	for i := range values {
+		values[i] = a[i][i]
+	}
+	return values, vectors
+}
+
+// 用runtime.NumCPU()个协程并行执行f(0)到f(n-1)，第w个协程执行编号模协程数为w的部分
+func parallelFor(n int, f func(i int)) {
+	workers := minInt(runtime.NumCPU(), n)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += workers {
+				f(i)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
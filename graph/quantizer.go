@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// hnswQuantizer 在粗聚类的聚心上建立hnsw图作为粗量化器，聚心编号即为桶编号。
+// M与ef为建图参数，M为0表示不使用hnsw而线性扫描所有聚心，efSearch为查找时的动态表大小
+type hnswQuantizer struct {
+	M        int
+	ef       int
+	efSearch int
+	graph    *Hnsw
+}
+
+// 在聚心上建立hnsw图，seed为抽取结点层级的随机种子，m为距离度量
+// 聚心个数不多，单协程插入，使图结构与分桶结果只由种子决定，与协程调度无关
+func (pointer *hnswQuantizer) build(center *floatMatrix, seed int64, m Metric) {
+	if pointer.M == 0 || center == nil {
+		return
+	}
+	graph := NewHnsw(pointer.M, pointer.ef)
+	graph.setSeed(seed)
+	graph.setMetric(m)
+	graph.workers = 1
+	ids := make([]int, center.rows)
+	for i := range ids {
+		ids[i] = i
+	}
+	if err := graph.addRows(ids, center); err != nil {
+		fmt.Print(err)
+		return
+	}
+	pointer.graph = graph
+}
+
+// 按度量m为矩阵rows的每一行找到最近的桶；未建立hnsw图时用分块内核批量计算
+func (pointer *hnswQuantizer) assign(center *floatMatrix, rows *floatMatrix, m Metric) []int {
+	if pointer.graph == nil {
+		indexs, _ := nearestRows(rows, center, m)
+		return indexs
+	}
+	indexs := make([]int, rows.rows)
+	for i := range indexs {
+		indexs[i] = pointer.nearestBuckets(center, *rows.vectorAt(i), 1, m)[0].index
+	}
+	return indexs
+}
+
+// 按度量m找到与输入向量最近的nprobe个桶，按距离由近到远排列；未建立hnsw图时线性扫描所有聚心
+func (pointer *hnswQuantizer) nearestBuckets(center *floatMatrix, inputVector floatVector, nprobe int, m Metric) []searchResult {
+	if nprobe < 1 {
+		nprobe = 1
+	}
+	if pointer.graph != nil {
+		return pointer.graph.searchVector(inputVector, nprobe, pointer.efSearch)
+	}
+	distances := make([]float64, center.rows)
+	m.scoreRows(toFloat32(inputVector.vector), center, nil, distances)
+	buckets := make([]searchResult, center.rows)
+	for index, distance := range distances {
+		buckets[index] = searchResult{index: index, distance: distance}
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].distance > buckets[j].distance
+	})
+	if len(buckets) > nprobe {
+		buckets = buckets[:nprobe]
+	}
+	return buckets
+}
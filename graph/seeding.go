@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// centerInit 聚类初始聚簇中心的选取方式
+type centerInit int
+
+const (
+	// InitRandom 随机选取num个采样点，为默认方式
+	InitRandom centerInit = iota
+	// InitKmeansPlusPlus k-means++：依次选取，每个点被选中的概率正比于它到已选中心的代价
+	InitKmeansPlusPlus
+	// InitKmeansParallel k-means||：每轮按代价独立过采样一批候选点，最后在加权的候选点上做k-means++，适用于采样点很多的情况
+	InitKmeansParallel
+)
+
+// k-means||的过采样轮数
+const kmeansParallelRounds = 5
+
+// 返回初始化方式的名称
+func (method centerInit) String() string {
+	switch method {
+	case InitRandom:
+		return "random"
+	case InitKmeansPlusPlus:
+		return "k-means++"
+	case InitKmeansParallel:
+		return "k-means||"
+	}
+	return fmt.Sprintf("centerInit(%d)", int(method))
+}
+
+// emptyReseed 聚类中空簇的重新选取方式
+type emptyReseed int
+
+const (
+	// ReseedSplit 分裂最大的簇：复制其中心并向相反方向轻微扰动，两个中心各分得一半的点，为默认方式
+	ReseedSplit emptyReseed = iota
+	// ReseedFarthest 取离所属中心最远的点作为新的中心
+	ReseedFarthest
+	// ReseedNone 不处理，空簇的中心保持不变
+	ReseedNone
+)
+
+// 分裂最大簇时的相对扰动
+const reseedEpsilon = 1.0 / 1024
+
+// 返回重新选取方式的名称
+func (method emptyReseed) String() string {
+	switch method {
+	case ReseedSplit:
+		return "split"
+	case ReseedFarthest:
+		return "farthest"
+	case ReseedNone:
+		return "none"
+	}
+	return fmt.Sprintf("emptyReseed(%d)", int(method))
+}
+
+// kmeansOptions 聚类训练的设置，零值为随机初始化，最多迭代kmeansMaxIterations轮，相对代价下降小于kmeansTolerance时停止，
+// 空簇按分裂最大簇的方式重新选取
+// maxIterations为最大迭代轮数，不大于0时取默认值；tolerance为相对代价下降的阈值，为0时取默认值，小于0时不按代价停止；
+// shiftTolerance为聚簇中心最大移动距离的阈值，不大于0时不按移动距离停止；reseed为空簇的重新选取方式
+// balance为均衡惩罚的步长：分配时每个中心的得分减去其惩罚，第i轮惩罚累加balance/i乘以每个点的平均代价与点数相对平均点数的偏差，为0时不惩罚
+type kmeansOptions struct {
+	init           centerInit
+	reseed         emptyReseed
+	maxIterations  int
+	tolerance      float64
+	shiftTolerance float64
+	balance        float64
+}
+
+// 按设置选取num个初始聚簇中心
+func initCenter(vectors *floatMatrix, num int, random *rand.Rand, m Metric, options kmeansOptions) *floatMatrix {
+	switch options.init {
+	case InitKmeansPlusPlus:
+		return kmeansPlusPlus(vectors, nil, num, random, m)
+	case InitKmeansParallel:
+		return kmeansParallel(vectors, num, random, m)
+	}
+	center := NewFloatMatrix(num, vectors.dim)
+	// 随机选取num个聚簇点作为初始聚簇中心
+	for i, index := range random.Perm(vectors.rows)[:num] {
+		copy(center.row(i), vectors.row(index))
+	}
+	return center
+}
+
+// 选取初始中心时使用的度量，内积不是距离，改用L2
+func seedMetric(m Metric) Metric {
+	if m == InnerProduct {
+		return L2
+	}
+	return m
+}
+
+// 把seedMetric下的得分转化为非负的代价：L2为距离的平方，余弦为1减去余弦
+func seedCost(m Metric, score float64) float64 {
+	cost := -score
+	if m == Cosine {
+		cost = 1 - score
+	}
+	if cost < 0 {
+		return 0
+	}
+	return cost
+}
+
+// 用新加入的中心更新每个点到已选中心的最小代价
+func updateSeedCost(vectors *floatMatrix, norms []float32, center []float32, m Metric, cost []float64) {
+	chunks := (vectors.rows + kernelChunk - 1) / kernelChunk
+	parallelFor(chunks, func(c int) {
+		start, end := c*kernelChunk, minInt((c+1)*kernelChunk, vectors.rows)
+		out := make([]float64, end-start)
+		m.scoreRows(center, vectors.rowRange(start, end), norms[start:end], out)
+		for i, score := range out {
+			if value := seedCost(m, score); value < cost[start+i] {
+				cost[start+i] = value
+			}
+		}
+	})
+}
+
+// 按权重与代价之积抽取一个点，总和为0时（所有点都与已选中心重合）均匀抽取
+func sampleByCost(cost []float64, weights []float64, random *rand.Rand) int {
+	var total float64
+	for i, value := range cost {
+		if weights != nil {
+			value *= weights[i]
+		}
+		total += value
+	}
+	if total == 0 {
+		return random.Intn(len(cost))
+	}
+	target := random.Float64() * total
+	for i, value := range cost {
+		if weights != nil {
+			value *= weights[i]
+		}
+		target -= value
+		if target < 0 {
+			return i
+		}
+	}
+	return len(cost) - 1
+}
+
+// k-means++ 在vectors中选取num个初始中心，weights为每个点的权重，为nil表示权重都为1
+func kmeansPlusPlus(vectors *floatMatrix, weights []float64, num int, random *rand.Rand, m Metric) *floatMatrix {
+	m = seedMetric(m)
+	norms := vectors.sqNorms()
+	center := NewFloatMatrix(0, vectors.dim)
+	// 第一个中心按权重抽取
+	cost := make([]float64, vectors.rows)
+	for i := range cost {
+		cost[i] = 1
+	}
+	chosen := sampleByCost(cost, weights, random)
+	for i := range cost {
+		cost[i] = math.Inf(1)
+	}
+	for {
+		center.appendRow(vectors.row(chosen))
+		if center.rows == num {
+			return center
+		}
+		updateSeedCost(vectors, norms, center.row(center.rows-1), m, cost)
+		chosen = sampleByCost(cost, weights, random)
+	}
+}
+
+// k-means|| 每轮以min(1, 2*num*代价/总代价)的概率独立选取候选点，kmeansParallelRounds轮后
+// 以每个候选点吸引的采样点个数为权重，在候选点上做k-means++得到num个初始中心
+func kmeansParallel(vectors *floatMatrix, num int, random *rand.Rand, m Metric) *floatMatrix {
+	seed := seedMetric(m)
+	candidates := NewFloatMatrix(0, vectors.dim)
+	candidates.appendRow(vectors.row(random.Intn(vectors.rows)))
+	cost := make([]float64, vectors.rows)
+	for i := range cost {
+		cost[i] = math.Inf(1)
+	}
+	updateSeedCost(vectors, vectors.sqNorms(), candidates.row(0), seed, cost)
+	oversampling := float64(2 * num)
+	for round := 0; round < kmeansParallelRounds; round++ {
+		var total float64
+		for _, value := range cost {
+			total += value
+		}
+		if total == 0 {
+			break
+		}
+		chosen := NewFloatMatrix(0, vectors.dim)
+		for i, value := range cost {
+			if random.Float64() < oversampling*value/total {
+				chosen.appendRow(vectors.row(i))
+			}
+		}
+		if chosen.rows == 0 {
+			continue
+		}
+		candidates.appendMatrix(chosen)
+		// 一轮选中的候选点一起更新代价
+		_, scores := nearestRows(vectors, chosen, seed)
+		for i, score := range scores {
+			if value := seedCost(seed, score); value < cost[i] {
+				cost[i] = value
+			}
+		}
+		fmt.Printf("k-means||第%d轮, 候选点%d个\n", round, candidates.rows)
+	}
+	// 候选点不足时退化为在全部采样点上做k-means++
+	if candidates.rows <= num {
+		return kmeansPlusPlus(vectors, nil, num, random, m)
+	}
+	weights := make([]float64, candidates.rows)
+	nearest, _ := nearestRows(vectors, candidates, seed)
+	for _, index := range nearest {
+		weights[index]++
+	}
+	return kmeansPlusPlus(candidates, weights, num, random, m)
+}
+
+// 重新选取失效的聚簇中心，dead标记失效的簇，count为每个簇的点数，neighbor与scores为本轮每个点所属的簇与得分
+// count随重新选取更新，返回重新选取的簇。新的中心不会与已有的中心重合：不取与某个中心相同的点，也不分裂只含相同点的簇，
+// 否则新中心分不到点，下一轮又会失效。没有可分裂的簇或可用的点时其余失效的中心保持不变
+func reseedCenters(center *floatMatrix, vectors *floatMatrix, dead []bool, count []int, neighbor []int,
+	scores []float64, m Metric, method emptyReseed) []int {
+	targets := make([]int, 0)
+	for j, isDead := range dead {
+		if isDead {
+			targets = append(targets, j)
+		}
+	}
+	reseeded := make([]int, 0)
+	if len(targets) == 0 || method == ReseedNone {
+		return reseeded
+	}
+	if method == ReseedFarthest {
+		// 按离所属中心由远到近依次取点，所属簇只剩一个点或点与某个有效的中心重合时不取
+		order := make([]int, len(scores))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return scores[order[a]] < scores[order[b]]
+		})
+		// vacant标记仍未重新选取的失效中心，已重新选取的中心也参与重合检查
+		vacant := append([]bool(nil), dead...)
+		next := 0
+		for _, j := range targets {
+			for next < len(order) && (count[neighbor[order[next]]] < 2 || onCenter(center, vacant, vectors.row(order[next]))) {
+				next++
+			}
+			if next == len(order) {
+				break
+			}
+			point := order[next]
+			next++
+			copy(center.row(j), vectors.row(point))
+			count[neighbor[point]]--
+			count[j] = 1
+			vacant[j] = false
+			reseeded = append(reseeded, j)
+		}
+		return reseeded
+	}
+	// 只分裂至少含两个不同点的簇，distinct标记这样的簇
+	distinct := make([]bool, len(count))
+	first := make([]int, len(count))
+	for j := range first {
+		first[j] = -1
+	}
+	for i, neigh := range neighbor {
+		if first[neigh] < 0 {
+			first[neigh] = i
+		} else if !distinct[neigh] && L2.score32(vectors.row(i), vectors.row(first[neigh])) != 0 {
+			distinct[neigh] = true
+		}
+	}
+	for _, j := range targets {
+		largest := -1
+		for k, size := range count {
+			if distinct[k] && (largest < 0 || size > count[largest]) {
+				largest = k
+			}
+		}
+		if largest < 0 || count[largest] < 2 {
+			break
+		}
+		row, origin := center.row(j), center.row(largest)
+		copy(row, origin)
+		for k := range row {
+			if k%2 == 0 {
+				row[k] *= 1 + reseedEpsilon
+				origin[k] *= 1 - reseedEpsilon
+			} else {
+				row[k] *= 1 - reseedEpsilon
+				origin[k] *= 1 + reseedEpsilon
+			}
+		}
+		count[j] = count[largest] / 2
+		count[largest] -= count[j]
+		reseeded = append(reseeded, j)
+	}
+	return reseeded
+}
+
+// 判断点是否与某个有效的中心重合，vacant标记不参与比较的失效中心
+func onCenter(center *floatMatrix, vacant []bool, point []float32) bool {
+	for j := 0; j < center.rows; j++ {
+		if !vacant[j] && L2.score32(point, center.row(j)) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 统计本轮重新选取的簇中阻止收敛的个数，before标记之前各轮重新选取过的簇，随本轮更新
+// 重新选取过又再次失效的簇（如上一轮刚重新选取，或几个中心轮流失效）说明该处维持不住中心，继续迭代也无济于事，不再阻止收敛
+func blockingReseeds(reseeded []int, before []bool) int {
+	blocking := 0
+	for _, j := range reseeded {
+		if !before[j] {
+			blocking++
+			before[j] = true
+		}
+	}
+	return blocking
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sparseVector 稀疏向量，indexs为非零维度的编号（严格递增），values为对应的取值
+type sparseVector struct {
+	indexs []int
+	values []float64
+}
+
+// NewSparseVector 向外生产一个稀疏向量，输入按维度编号排序，重复的维度取值相加，取值为0的维度被略过
+func NewSparseVector(indexs []int, values []float64) (*sparseVector, error) {
+	if len(indexs) != len(values) {
+		return nil, errors.New("稀疏向量的维度个数与取值个数不匹配")
+	}
+	order := make([]int, len(indexs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return indexs[order[i]] < indexs[order[j]]
+	})
+	vector := &sparseVector{indexs: make([]int, 0, len(indexs)), values: make([]float64, 0, len(values))}
+	for _, i := range order {
+		if indexs[i] < 0 {
+			return nil, fmt.Errorf("稀疏向量的维度编号%d小于0", indexs[i])
+		}
+		last := len(vector.indexs) - 1
+		if last >= 0 && vector.indexs[last] == indexs[i] {
+			vector.values[last] += values[i]
+			continue
+		}
+		vector.indexs = append(vector.indexs, indexs[i])
+		vector.values = append(vector.values, values[i])
+	}
+	// 去掉相加后为0的维度
+	n := 0
+	for i, value := range vector.values {
+		if value != 0 {
+			vector.indexs[n], vector.values[n] = vector.indexs[i], value
+			n++
+		}
+	}
+	vector.indexs, vector.values = vector.indexs[:n], vector.values[:n]
+	return vector, nil
+}
+
+// 与另一个稀疏向量的内积，按维度编号归并
+func (pointer *sparseVector) dot(input sparseVector) float64 {
+	var sum float64
+	i, j := 0, 0
+	for i < len(pointer.indexs) && j < len(input.indexs) {
+		switch {
+		case pointer.indexs[i] < input.indexs[j]:
+			i++
+		case pointer.indexs[i] > input.indexs[j]:
+			j++
+		default:
+			sum += pointer.values[i] * input.values[j]
+			i++
+			j++
+		}
+	}
+	return sum
+}
+
+// 将稀疏向量转化为String类型，每一项为"维度:取值"
+func (pointer *sparseVector) toStrings() []string {
+	strs := make([]string, len(pointer.indexs))
+	for i, index := range pointer.indexs {
+		strs[i] = strconv.Itoa(index) + ":" + strconv.FormatFloat(pointer.values[i], 'f', -1, 64)
+	}
+	return strs
+}
+
+// stringToSparse 将"维度:取值"形式的字符串数组转化为稀疏向量
+func stringToSparse(data []string) (*sparseVector, error) {
+	indexs := make([]int, 0, len(data))
+	values := make([]float64, 0, len(data))
+	for _, element := range data {
+		element = strings.TrimSpace(element)
+		if element == "" {
+			continue
+		}
+		pair := strings.SplitN(element, ":", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("稀疏向量的项%s不是\"维度:取值\"的形式", element)
+		}
+		index, err := strconv.Atoi(pair[0])
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.ParseFloat(pair[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		indexs = append(indexs, index)
+		values = append(values, value)
+	}
+	return NewSparseVector(indexs, values)
+}
+
+// loadSparseData 载入稀疏向量文件，每行为一个向量，每列为"维度:取值"
+func loadSparseData(path string) ([]*sparseVector, error) {
+	_, vectors, err := loadSparseFile(path, false)
+	return vectors, err
+}
+
+// 读取稀疏向量csv文件，withIndex表示第一列为编号
+func loadSparseFile(path string, withIndex bool) (indexs []int, vectors []*sparseVector, err error) {
+	csvFile, err := os.Open(path)
+	if err != nil {
+		fmt.Print("文件似乎不存在")
+		return nil, nil, errors.New("Load file error")
+	}
+	defer csvFile.Close()
+	indexs = make([]int, 0)
+	vectors = make([]*sparseVector, 0)
+	csvReader := csv.NewReader(csvFile)
+	// 每个向量的非零项个数不同
+	csvReader.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		inputString, readerError := csvReader.Read()
+		if readerError == io.EOF {
+			break
+		}
+		if readerError != nil {
+			return nil, nil, readerError
+		}
+		if withIndex {
+			index, err := strconv.Atoi(inputString[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s第%d行编号错误: %v", path, line, err)
+			}
+			indexs = append(indexs, index)
+			inputString = inputString[1:]
+		}
+		vector, err := stringToSparse(inputString)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s第%d行: %v", path, line, err)
+		}
+		vectors = append(vectors, vector)
+	}
+	return indexs, vectors, nil
+}
+
+// sparsePosting 倒排表的一项，row为向量在索引中的行号，value为该向量在此维度的取值
+type sparsePosting struct {
+	row   int
+	value float32
+}
+
+// SparseIndex 稀疏向量的倒排索引，按内积查找
+// postings为每个维度的倒排表，ids为每一行的外部编号，rows为外部编号到行号的映射
+// nextID为createIndex分配的下一个外部编号，只增不减，mu保护以上结构，插入持写锁，查询持读锁
+type SparseIndex struct {
+	postings map[int][]sparsePosting
+	ids      []int
+	rows     map[int]int
+	nextID   int
+	mu       sync.RWMutex
+}
+
+// NewSparseIndex 向外生产一个稀疏倒排索引
+func NewSparseIndex() *SparseIndex {
+	return &SparseIndex{postings: make(map[int][]sparsePosting), ids: make([]int, 0), rows: make(map[int]int)}
+}
+
+// 建立索引 path为稀疏向量csv文件路径，向量的外部编号从nextID起依次分配，不会与已有编号重复
+func (pointer *SparseIndex) createIndex(path string) error {
+	vectors, err := loadSparseData(path)
+	if err != nil {
+		return err
+	}
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	start := pointer.nextID
+	for i, vector := range vectors {
+		pointer.add(start+i, *vector)
+	}
+	return nil
+}
+
+// Add 插入一个稀疏向量，id为向量的外部编号，不能与已有编号重复
+func (pointer *SparseIndex) Add(id int, vector sparseVector) error {
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	if _, ok := pointer.rows[id]; ok {
+		return fmt.Errorf("编号%d已存在", id)
+	}
+	pointer.add(id, vector)
+	return nil
+}
+
+// 追加一行并写入倒排表，调用者需持有写锁并已检查编号不重复
+func (pointer *SparseIndex) add(id int, vector sparseVector) {
+	row := len(pointer.ids)
+	pointer.ids = append(pointer.ids, id)
+	pointer.rows[id] = row
+	if id >= pointer.nextID {
+		pointer.nextID = id + 1
+	}
+	for i, index := range vector.indexs {
+		pointer.postings[index] = append(pointer.postings[index], sparsePosting{row: row, value: float32(vector.values[i])})
+	}
+}
+
+// 查找与输入向量内积最大的k个向量，返回结果的index为外部编号，distance为内积，按内积由大到小排列
+// 只有与输入向量至少有一个共同非零维度的向量才会被返回
+func (pointer *SparseIndex) searchVector(inputVector sparseVector, k int) []searchResult {
+	pointer.mu.RLock()
+	defer pointer.mu.RUnlock()
+	// 按行累加各维度的得分，touched记录得分被累加过的行
+	scores := make([]float64, len(pointer.ids))
+	seen := make([]bool, len(pointer.ids))
+	touched := make([]int, 0)
+	for i, index := range inputVector.indexs {
+		value := inputVector.values[i]
+		for _, posting := range pointer.postings[index] {
+			if !seen[posting.row] {
+				seen[posting.row] = true
+				touched = append(touched, posting.row)
+			}
+			scores[posting.row] += value * float64(posting.value)
+		}
+	}
+	nearest := &resultHeap{nearest: false}
+	for _, row := range touched {
+		nearest.pushTop(searchResult{index: pointer.ids[row], distance: scores[row]}, k)
+	}
+	return nearest.sorted()
+}
+
+// 存储索引 path为csv文件路径，每行为外部编号与该向量的各项"维度:取值"
+func (pointer *SparseIndex) storeIndex(path string) error {
+	pointer.mu.RLock()
+	defer pointer.mu.RUnlock()
+	// 由倒排表还原每一行的向量，按维度编号顺序遍历以保证各项有序
+	dims := make([]int, 0, len(pointer.postings))
+	for index := range pointer.postings {
+		dims = append(dims, index)
+	}
+	sort.Ints(dims)
+	lines := make([][]string, len(pointer.ids))
+	for row, id := range pointer.ids {
+		lines[row] = []string{strconv.Itoa(id)}
+	}
+	for _, index := range dims {
+		for _, posting := range pointer.postings[index] {
+			item := strconv.Itoa(index) + ":" + strconv.FormatFloat(float64(posting.value), 'f', -1, 32)
+			lines[posting.row] = append(lines[posting.row], item)
+		}
+	}
+	outputFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	outputWriter := csv.NewWriter(outputFile)
+	if err := outputWriter.WriteAll(lines); err != nil {
+		return err
+	}
+	return outputWriter.Error()
+}
+
+// 加载storeIndex生成的索引，会清空已有的内容
+func (pointer *SparseIndex) loadIndex(path string) error {
+	ids, vectors, err := loadSparseFile(path, true)
+	if err != nil {
+		return err
+	}
+	// 先检查编号不重复，出错时不改动已有的内容
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			return fmt.Errorf("编号%d重复", id)
+		}
+		seen[id] = true
+	}
+	pointer.mu.Lock()
+	defer pointer.mu.Unlock()
+	pointer.postings, pointer.ids, pointer.rows, pointer.nextID = make(map[int][]sparsePosting), make([]int, 0, len(ids)), make(map[int]int, len(ids)), 0
+	for i, vector := range vectors {
+		pointer.add(ids[i], *vector)
+	}
+	return nil
+}
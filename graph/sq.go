@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// sqType 标量量化的编码方式
+type sqType int
+
+const (
+	// SQ8 每一维编码为8位整数，按该维的最小值与最大值均匀划分
+	SQ8 sqType = iota
+	// SQ4 每一维编码为4位整数，两维共用一个字节
+	SQ4
+	// FP16 每一维存为半精度浮点数，不需要训练
+	FP16
+)
+
+// 标量量化参数文件的标识与版本
+const (
+	sqMagic   = "SQTZ"
+	sqVersion = 1
+)
+
+// 返回编码方式的名称
+func (kind sqType) String() string {
+	switch kind {
+	case SQ8:
+		return "sq8"
+	case SQ4:
+		return "sq4"
+	case FP16:
+		return "fp16"
+	}
+	return fmt.Sprintf("sqType(%d)", int(kind))
+}
+
+// scalarQuantizer 标量量化器，把向量的每一维独立编码
+// kind为编码方式，dim为向量维度，min与max为每一维在训练样本上的最小值与最大值，
+// scale为每一维相邻两个编码之间的间隔，由min与max算出
+type scalarQuantizer struct {
+	kind  sqType
+	dim   int
+	min   []float32
+	max   []float32
+	scale []float32
+}
+
+// NewScalarQuantizer 向外生产一个标量量化器，需在样本上训练后才能编码
+func NewScalarQuantizer(kind sqType) *scalarQuantizer {
+	return &scalarQuantizer{kind: kind}
+}
+
+// 是否已经训练，nil表示不使用标量量化
+func (pointer *scalarQuantizer) trained() bool {
+	return pointer != nil && pointer.min != nil
+}
+
+// 编码的最大取值
+func (pointer *scalarQuantizer) levels() float32 {
+	if pointer.kind == SQ4 {
+		return 15
+	}
+	return 255
+}
+
+// 每个向量编码后的字节数
+func (pointer *scalarQuantizer) codeSize() int {
+	switch pointer.kind {
+	case SQ4:
+		return (pointer.dim + 1) / 2
+	case FP16:
+		return pointer.dim * 2
+	}
+	return pointer.dim
+}
+
+// 在样本上统计每一维的最小值与最大值
+func (pointer *scalarQuantizer) train(vectors *floatMatrix) error {
+	if vectors.rows == 0 {
+		return errors.New("标量量化的训练样本为空")
+	}
+	pointer.dim = vectors.dim
+	pointer.min = make([]float32, vectors.dim)
+	pointer.max = make([]float32, vectors.dim)
+	copy(pointer.min, vectors.row(0))
+	copy(pointer.max, vectors.row(0))
+	for i := 1; i < vectors.rows; i++ {
+		for j, value := range vectors.row(i) {
+			if value < pointer.min[j] {
+				pointer.min[j] = value
+			}
+			if value > pointer.max[j] {
+				pointer.max[j] = value
+			}
+		}
+	}
+	pointer.updateScale()
+	return nil
+}
+
+// 由最小值与最大值算出每一维的编码间隔，取值恒定的维度间隔为0
+func (pointer *scalarQuantizer) updateScale() {
+	pointer.scale = make([]float32, pointer.dim)
+	for j := range pointer.scale {
+		pointer.scale[j] = (pointer.max[j] - pointer.min[j]) / pointer.levels()
+	}
+}
+
+// 把第j维的取值编码为整数，超出训练范围的取值截断到边界
+func (pointer *scalarQuantizer) quantize(j int, value float32) byte {
+	if pointer.scale[j] == 0 {
+		return 0
+	}
+	code := math.Round(float64((value - pointer.min[j]) / pointer.scale[j]))
+	if code < 0 {
+		code = 0
+	}
+	if code > float64(pointer.levels()) {
+		code = float64(pointer.levels())
+	}
+	return byte(code)
+}
+
+// 编码一个向量，结果写入code，code的长度为codeSize
+func (pointer *scalarQuantizer) encode(vector []float32, code []byte) {
+	switch pointer.kind {
+	case SQ4:
+		for i := range code {
+			code[i] = 0
+		}
+		for j, value := range vector {
+			code[j/2] |= pointer.quantize(j, value) << uint(4*(j%2))
+		}
+	case FP16:
+		for j, value := range vector {
+			binary.LittleEndian.PutUint16(code[2*j:], float32ToHalf(value))
+		}
+	default:
+		for j, value := range vector {
+			code[j] = pointer.quantize(j, value)
+		}
+	}
+}
+
+// 编码一个矩阵的所有行，返回连续存放的编码
+func (pointer *scalarQuantizer) encodeRows(rows *floatMatrix) []byte {
+	size := pointer.codeSize()
+	codes := make([]byte, rows.rows*size)
+	for i := 0; i < rows.rows; i++ {
+		pointer.encode(rows.row(i), codes[i*size:(i+1)*size])
+	}
+	return codes
+}
+
+// 返回编码中第j维还原后的取值
+func (pointer *scalarQuantizer) value(code []byte, j int) float32 {
+	switch pointer.kind {
+	case SQ4:
+		return pointer.min[j] + pointer.scale[j]*float32(code[j/2]>>uint(4*(j%2))&15)
+	case FP16:
+		return halfToFloat32(binary.LittleEndian.Uint16(code[2*j:]))
+	}
+	return pointer.min[j] + pointer.scale[j]*float32(code[j])
+}
+
+// 把编码还原为向量
+func (pointer *scalarQuantizer) decode(code []byte) []float32 {
+	vector := make([]float32, pointer.dim)
+	for j := range vector {
+		vector[j] = pointer.value(code, j)
+	}
+	return vector
+}
+
+// 直接在编码上计算查询向量与每个编码向量的得分，不还原出整个向量
+// codes为连续存放的编码，out[i]为第i个编码向量的得分，规则与score32相同
+func (pointer *scalarQuantizer) scoreCodes(query []float32, codes []byte, m Metric, out []float64) {
+	size := pointer.codeSize()
+	qNorm := dot32(query, query)
+	for i := range out {
+		code := codes[i*size : (i+1)*size]
+		var dot, norm float32
+		for j, q := range query {
+			value := pointer.value(code, j)
+			dot += q * value
+			norm += value * value
+		}
+		out[i] = m.fromDot(dot, qNorm, norm)
+	}
+}
+
+// 在编码上找到与查询向量得分最大的编码向量，返回其序号与得分，没有编码时返回-1
+func (pointer *scalarQuantizer) bestCode(query []float32, codes []byte, m Metric) (int, float64) {
+	out := make([]float64, len(codes)/pointer.codeSize())
+	pointer.scoreCodes(query, codes, m, out)
+	best, bestScore := -1, math.Inf(-1)
+	for i, score := range out {
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best, bestScore
+}
+
+// 把float32转换为半精度浮点数，尾数按就近舍入，超出范围时为无穷大
+func float32ToHalf(value float32) uint16 {
+	bits := math.Float32bits(value)
+	sign := uint16(bits>>16) & 0x8000
+	exponent := int(bits>>23&0xff) - 127 + 15
+	mantissa := bits & 0x7fffff
+	switch {
+	case bits&0x7fffffff == 0:
+		return sign
+	case bits>>23&0xff == 0xff:
+		// 无穷大与NaN
+		if mantissa != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exponent >= 31:
+		return sign | 0x7c00
+	case exponent <= 0:
+		// 非规格化数，太小时为0
+		if exponent < -10 {
+			return sign
+		}
+		mantissa |= 0x800000
+		shift := uint(14 - exponent)
+		half := mantissa >> shift
+		rest := mantissa & (1<<shift - 1)
+		middle := uint32(1) << (shift - 1)
+		if rest > middle || (rest == middle && half&1 == 1) {
+			half++
+		}
+		return sign | uint16(half)
+	}
+	half := uint32(exponent)<<10 | mantissa>>13
+	rest := mantissa & 0x1fff
+	if rest > 0x1000 || (rest == 0x1000 && half&1 == 1) {
+		// 进位可能使指数加一，溢出时恰好得到无穷大
+		half++
+	}
+	return sign | uint16(half)
+}
+
+// 把半精度浮点数转换为float32
+func halfToFloat32(half uint16) float32 {
+	sign := uint32(half&0x8000) << 16
+	exponent := uint32(half>>10) & 0x1f
+	mantissa := uint32(half & 0x3ff)
+	switch exponent {
+	case 0:
+		if mantissa == 0 {
+			return math.Float32frombits(sign)
+		}
+		// 非规格化数
+		value := float32(mantissa) / (1 << 24)
+		if sign != 0 {
+			return -value
+		}
+		return value
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	}
+	return math.Float32frombits(sign | (exponent+127-15)<<23 | mantissa<<13)
+}
+
+// 将量化参数写入writer，依次为标识、版本、编码方式、维度、每一维的最小值与最大值
+func (pointer *scalarQuantizer) writeTo(writer io.Writer) error {
+	fields := []interface{}{
+		[]byte(sqMagic), uint32(sqVersion),
+		int64(pointer.kind), int64(pointer.dim), pointer.min, pointer.max,
+	}
+	for _, field := range fields {
+		if err := binary.Write(writer, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 从reader读取writeTo写入的量化参数
+func (pointer *scalarQuantizer) readFrom(reader io.Reader) error {
+	magic := make([]byte, len(sqMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != sqMagic {
+		return errors.New("不是标量量化参数文件")
+	}
+	var version uint32
+	if err := binary.Read(reader, binary.LittleEndian, &version); err != nil {
+		return err
+	}
+	if version != sqVersion {
+		return fmt.Errorf("标量量化参数文件版本为%d, 当前只支持版本%d", version, sqVersion)
+	}
+	var kind, dim int64
+	if err := binary.Read(reader, binary.LittleEndian, &kind); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &dim); err != nil {
+		return err
+	}
+	pointer.kind, pointer.dim = sqType(kind), int(dim)
+	pointer.min = make([]float32, dim)
+	pointer.max = make([]float32, dim)
+	if err := binary.Read(reader, binary.LittleEndian, pointer.min); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.LittleEndian, pointer.max); err != nil {
+		return err
+	}
+	pointer.updateScale()
+	return nil
+}
+
+// 把量化参数存入path
+func (pointer *scalarQuantizer) storeQuantizer(path string) error {
+	outputFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	writer := bufio.NewWriter(outputFile)
+	if err := pointer.writeTo(writer); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// 索引的标量量化器尚未训练时从path加载，文件不存在表示建立索引时没有使用标量量化，返回nil
+func loadQuantizerIfExist(sq *scalarQuantizer, path string) *scalarQuantizer {
+	if sq.trained() {
+		return sq
+	}
+	inputFile, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		fmt.Print(err)
+		return sq
+	}
+	defer inputFile.Close()
+	loaded := &scalarQuantizer{}
+	if err := loaded.readFrom(bufio.NewReader(inputFile)); err != nil {
+		fmt.Print(err)
+		return sq
+	}
+	return loaded
+}
+
+// 把一批编码追加写入桶文件，每条记录为8字节编号与codeSize字节的编码，记录定长以便多次追加
+func writeCodeBucket(path string, ids []int, codes []byte, size int) error {
+	outputFile, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	writer := bufio.NewWriter(outputFile)
+	for i, id := range ids {
+		if err := binary.Write(writer, binary.LittleEndian, int64(id)); err != nil {
+			return err
+		}
+		if _, err := writer.Write(codes[i*size : (i+1)*size]); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// 载入writeCodeBucket生成的桶文件，返回编号与连续存放的编码
+func loadCodeBucket(path string, size int) (indexs []int, codes []byte, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	record := 8 + size
+	if len(data)%record != 0 {
+		return nil, nil, fmt.Errorf("%s长度%d不是记录长度%d的整数倍", path, len(data), record)
+	}
+	count := len(data) / record
+	indexs = make([]int, count)
+	codes = make([]byte, 0, count*size)
+	for i := 0; i < count; i++ {
+		indexs[i] = int(int64(binary.LittleEndian.Uint64(data[i*record:])))
+		codes = append(codes, data[i*record+8:(i+1)*record]...)
+	}
+	return indexs, codes, nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"os"
 	"sort"
@@ -14,6 +15,16 @@ import (
 	"time"
 )
 
+// 由种子生成随机数生成器
+func newRand(seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed))
+}
+
+// 以当前时间为种子生成随机数生成器，未指定种子时使用
+func newTimeRand() *rand.Rand {
+	return newRand(time.Now().UnixNano())
+}
+
 // Index 是索引接口，展示索引所需要的功能
 type Index interface {
 	createIndex(path string) string
@@ -36,153 +47,227 @@ func dirSort(listDirs []string) []string {
 	return result
 }
 
-// 获取最近向量 vector表示待比较向量 vectors表示向量组
-func getNeighVector(vector floatVector, pointerVectors *floatVectors, ch chan int) {
-	maxIndex, maxDistance := 0, -100000.0
-	for centerIndex, centerPoint := range pointerVectors.vectors {
-		distance, err := vector.distance(centerPoint, true)
-		if err != nil {
-			fmt.Print("计算出错")
-		}
+// 按度量m在矩阵中找到与vector最近的行，返回其行号与得分
+func nearestIndex(vector []float32, centers *floatMatrix, m Metric) (int, float64) {
+	maxIndex, maxDistance := 0, math.Inf(-1)
+	for centerIndex := 0; centerIndex < centers.rows; centerIndex++ {
+		distance := m.score32(vector, centers.row(centerIndex))
 		if distance > maxDistance {
 			maxDistance = distance
 			maxIndex = centerIndex
 		}
 	}
-	ch <- maxIndex
+	return maxIndex, maxDistance
 }
 
-// stringToFloats表示将字符串转换为浮点数组
+// stringToFloats表示将字符串转换为浮点数组，无法解析的单元格为0，过短时补0
+// 返回第一个无法解析的单元格的错误，但仍返回转换结果；过长时返回nil与错误
 func stringToFloats(data []string, length int, splitString string) ([]float64, error) {
 	vector := make([]float64, length)
 	// 按某个字符分割
 	if len(data) > length {
 		return nil, errors.New("vectors' dim error")
 	}
+	var parseError error
 	for i, element := range data {
-		vectorElement, _ := strconv.ParseFloat(element, 64)
+		vectorElement, err := strconv.ParseFloat(element, 64)
+		if err != nil && parseError == nil {
+			parseError = fmt.Errorf("第%d列: %v", i+1, err)
+		}
 		vector[i] = vectorElement
 	}
-	return vector, nil
+	return vector, parseError
 }
 
-// loadBucket 载入桶 indexs表示Bucket所有数编号， vectors表示buvket所有数的向量组
-func loadBucket(path string, length int) (indexs []int, vectors [][]float64, err error) {
-	indexs = make([]int, 0)
+// loadBucket 载入桶 indexs表示Bucket所有数编号， vectors表示buvket所有数的向量组，第i行的编号为indexs[i]
+func loadBucket(path string, length int) (indexs []int, vectors *floatMatrix, err error) {
+	return loadBucketWith(path, length, nil)
+}
+
+// loadBucketWith 按载入设置载入桶，options为nil时与loadBucket相同
+func loadBucketWith(path string, length int, options *ingestOptions) (indexs []int, vectors *floatMatrix, err error) {
+	indexs, vectors, _, err = loadRows(path, length, true, options)
+	return indexs, vectors, err
+}
+
+// path为向量路径， len为向量产生长度
+func loadData(path string, length int) (*floatMatrix, error) {
+	return loadDataWith(path, length, nil)
+}
+
+// loadDataWith 按载入设置载入向量文件，options为nil时与loadData相同
+func loadDataWith(path string, length int, options *ingestOptions) (*floatMatrix, error) {
+	_, vectors, _, err := loadRows(path, length, false, options)
+	return vectors, err
+}
+
+// 读取向量csv文件 withIndex表示第一列为编号，否则返回的indexs为每个向量在文件中的行序号（从0开始）
+// 每行解析后直接以float32追加到矩阵中，不保留float64的中间结果，第i行的编号为indexs[i]
+// records为文件的总行数，包括被跳过的行。options为nil时宽松载入，忽略所有错误，列数过多的行被跳过
+func loadRows(path string, length int, withIndex bool, options *ingestOptions) (indexs []int, vectors *floatMatrix, records int, err error) {
 	csvFile, err := os.Open(path)
 	if err != nil {
 		fmt.Print("文件似乎不存在")
-		return nil, nil, errors.New("Load file error")
+		return nil, nil, 0, errors.New("Load file error")
 	}
 	defer csvFile.Close()
-	vectors = make([][]float64, 0)
+	indexs = make([]int, 0)
+	vectors = NewFloatMatrix(0, length)
 	csvReader := csv.NewReader(csvFile)
-	for {
-		vector := make([]float64, length)
-		inputString, readerError := csvReader.Read()
-		if readerError == io.EOF {
-			break
-		}
-		index := inputString[0]
-		inputString = inputString[1:]
-		indexInt, _ := strconv.Atoi(index)
-		indexs = append(indexs, indexInt)
-		vector, _ = stringToFloats(inputString, length, ",")
-		vectors = append(vectors, vector)
-	}
-	return indexs, vectors, nil
-}
-
-// path为向量路径， len为向量产生长度
-func loadData(path string, length int) ([][]float64, error) {
-	csvfile, err := os.Open(path)
-	if err != nil {
-		fmt.Print("文件似乎不存在")
-		return nil, errors.New("Load file error")
+	if options != nil {
+		// 列数由parseRow检查，以便报告具体的行号
+		csvReader.FieldsPerRecord = -1
 	}
-	defer csvfile.Close()
-	vectors := make([][]float64, 0)
-	csvReader := csv.NewReader(csvfile)
-	for {
-		vector := make([]float64, length)
+	skipped := 0
+	for ; ; records++ {
 		inputString, readerError := csvReader.Read()
 		if readerError == io.EOF {
 			break
 		}
-		vector, _ = stringToFloats(inputString, length, ",")
-		vectors = append(vectors, vector)
+		index := records
+		if options == nil {
+			if withIndex {
+				index, _ = strconv.Atoi(inputString[0])
+				inputString = inputString[1:]
+			}
+			vector, _ := stringToFloats(inputString, length, ",")
+			if vector == nil {
+				continue
+			}
+			indexs = append(indexs, index)
+			vectors.appendFloat64(vector)
+			continue
+		}
+		line := records + 1
+		if readerError != nil {
+			// csv格式错误的行无法使用，按日志处理时也只能跳过
+			problem := &ingestError{path: path, line: line, problem: ProblemMalformed, message: readerError.Error()}
+			if parseError, ok := readerError.(*csv.ParseError); ok {
+				problem.line, problem.column, problem.message = parseError.Line, parseError.Column, parseError.Err.Error()
+			}
+			if _, err := options.handle(problem); err != nil {
+				return nil, nil, 0, err
+			}
+			skipped++
+			continue
+		}
+		offset := 0
+		if withIndex {
+			var keep bool
+			index, keep, err = options.parseIndex(path, line, inputString[0])
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			if !keep {
+				skipped++
+				continue
+			}
+			inputString, offset = inputString[1:], 1
+		}
+		vector, keep, err := options.parseRow(path, line, offset, inputString, length)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if !keep {
+			skipped++
+			continue
+		}
+		indexs = append(indexs, index)
+		vectors.appendFloat64(vector)
+	}
+	if skipped > 0 {
+		fmt.Printf("%s共%d行, 跳过%d行有问题的数据\n", path, records, skipped)
 	}
-	return vectors, nil
+	return indexs, vectors, records, nil
 }
 
 // 寻找聚类中心 num表示聚类点数 length表示向量维度 vectors 表示采样点，codenum为编号，仅用于辅助打印
-// center表示采样结果
-func searchCenter(num int, length int, vectors *floatVectors, codeNum int) *floatVectors {
-	center := NewFloatVectors()
-	// 随机选取num个聚簇点作为初始聚簇中心
-	randArray := make([]int, num)
-	rand.Seed(time.Now().Unix())
-	copy(randArray, rand.Perm(vectors.length)[:num])
-	for _, index := range randArray {
-		vector := NewFloatVector(length)
-		vector.SetVector(vectors.vectors[index].vector)
-		center.Append(*vector)
-	}
-	for i := 0; i < 500; i++ {
-		neighbor := make([]int, vectors.length)
+// random为随机数生成器，用于选取初始聚簇中心，m为分配与更新聚簇中心使用的距离度量，options为初始化方式等训练设置
+// center表示采样结果，report为训练报告
+func searchCenter(num int, length int, vectors *floatMatrix, codeNum int, random *rand.Rand, m Metric, options kmeansOptions) (center *floatMatrix, report *kmeansReport) {
+	start := time.Now()
+	center = initCenter(vectors, num, random, m, options)
+	report = refineCenter(center, vectors, codeNum, m, options)
+	report.elapsed = time.Since(start)
+	fmt.Printf("聚心%d%s\n", codeNum, report)
+	return center, report
+}
+
+// 从已有的聚簇中心center出发迭代，每轮重新分配采样点并更新聚簇中心，结果写回center
+// 达到options的最大轮数或收敛时停止，返回训练报告
+func refineCenter(center *floatMatrix, vectors *floatMatrix, codeNum int, m Metric, options kmeansOptions) *kmeansReport {
+	start := time.Now()
+	num, length := center.rows, center.dim
+	report := &kmeansReport{inertia: make([]float64, 0)}
+	previous := NewFloatMatrix(num, length)
+	copy(previous.data, center.data)
+	var penalty []float64
+	// reseededBefore标记之前各轮重新选取过的簇
+	reseededBefore := make([]bool, num)
+	for i := 0; i < options.iterations(); i++ {
+		// 分块批量计算每个采样点最近的聚簇中心，使用均衡惩罚时按之前各轮累加的惩罚压低大簇的得分
+		neighbor, scores := nearestRowsPenalized(vectors, center, m, penalty)
+		report.inertia = append(report.inertia, inertiaOf(scores, m))
+		report.iterations = i + 1
 		var wg sync.WaitGroup
-		for index, vector := range vectors.vectors {
-			wg.Add(1)
-			go func(index int, vector floatVector) {
-				defer wg.Done()
-				maxIndex, maxDistance := 0, -100000.0
-				for centerIndex, centerPoint := range center.vectors {
-					distance, err := vector.distance(centerPoint, true)
-					if err != nil {
-						fmt.Print("计算出错")
-					}
-					if distance > maxDistance {
-						maxDistance = distance
-						maxIndex = centerIndex
-					}
-				}
-				neighbor[index] = maxIndex
-			}(index, vector)
-		}
-		wg.Wait()
 		// 重新计算每个簇的中心
 		//count用来存储每个聚簇中心点的个数
-		// 聚簇中心数据清零
-		for j := 0; j < center.length; j++ {
-			center.vectors[j].resetVector()
-		}
 		count := make([]int, num)
+		members := make([][]int, num)
 		for j, neigh := range neighbor {
 			count[neigh]++
-			wg.Add(1)
-			go func(j int, neigh int) {
-				defer wg.Done()
-				center.vectors[neigh].addVector(vectors.vectors[j])
-			}(j, neigh)
+			members[neigh] = append(members[neigh], j)
 		}
-		wg.Wait()
-		for j := 0; j < center.length; j++ {
+		// 每个聚簇中心由一个协程按固定顺序以float64累加，保证结果可复现
+		// 空簇与无法更新的簇（余弦度量下簇内向量之和为0）记为失效
+		dead := make([]bool, num)
+		for j := 0; j < center.rows; j++ {
 			wg.Add(1)
 			go func(j int) {
 				defer wg.Done()
-				center.vectors[j].divNum(count[j])
+				sum := make([]float64, length)
+				for _, member := range members[j] {
+					for k, value := range vectors.row(member) {
+						sum[k] += float64(value)
+					}
+				}
+				if err := m.updateCenter(center.row(j), sum, count[j]); err != nil {
+					dead[j] = true
+				}
 			}(j)
 		}
 		wg.Wait()
+		report.sizes = append([]int(nil), count...)
+		reseeded := reseedCenters(center, vectors, dead, count, neighbor, scores, m, options.reseed)
+		blocking := blockingReseeds(reseeded, reseededBefore)
+		// 重新选取中心后簇的划分已经改变，均衡惩罚重新累加
+		if options.balance > 0 && len(reseeded) == 0 {
+			penalty = balancePenalty(penalty, count, options.balance/float64(i+1), math.Abs(report.inertia[i])/float64(vectors.rows))
+		} else {
+			penalty = nil
+		}
+		report.reseeded += len(reseeded)
 		if i%200 == 0 {
 			fmt.Printf("聚心%d运行%d次", codeNum, i)
 		}
+		// 本轮分配的代价与上一轮比较，中心移动距离为本轮更新前后的最大距离
+		var shift float64
+		for j := 0; j < num; j++ {
+			shift = math.Max(shift, -L2.score32(previous.row(j), center.row(j)))
+		}
+		shift = math.Sqrt(shift)
+		copy(previous.data, center.data)
+		if blocking == 0 && i > 0 && options.converged(report.inertia[i-1], report.inertia[i], shift) {
+			report.converged = true
+			break
+		}
 	}
-	return center
+	report.elapsed = time.Since(start)
+	return report
 }
 
-// 载入聚类中心
-func loadCenter(path string) *floatVectors {
+// 载入聚类中心 length为向量维度
+func loadCenter(path string, length int) *floatMatrix {
 	inputFile, inputError := os.Open(path)
 	if inputError != nil {
 		fmt.Printf("An error occurred on opening the inputfile\n" +
@@ -190,7 +275,7 @@ func loadCenter(path string) *floatVectors {
 			"Have you got acces to it?\n")
 	}
 	defer inputFile.Close()
-	center := NewFloatVectors()
+	center := NewFloatMatrix(0, length)
 	inputReader := csv.NewReader(inputFile)
 	for {
 		inputString, readerError := inputReader.Read()
@@ -198,21 +283,19 @@ func loadCenter(path string) *floatVectors {
 			break
 		}
 		inputString = inputString[1:]
-		inputFloatArray := make([]float64, 0)
-		for _, element := range inputString {
+		inputFloatArray := make([]float64, length)
+		for i, element := range inputString {
 			inputFloat, _ := strconv.ParseFloat(element, 64)
-			inputFloatArray = append(inputFloatArray, inputFloat)
+			inputFloatArray[i] = inputFloat
 		}
-		vector := NewFloatVector(1024)
-		vector.SetVector(inputFloatArray)
-		center.Append(*vector)
+		center.appendFloat64(inputFloatArray)
 	}
 	return center
 }
 
-// 载入pq量化中心
-func loadPqcenter(path string, M int) [](*floatVectors) {
-	pqCenter := make([]*floatVectors, M)
+// 载入pq量化中心 dim为每个量化区块维度
+func loadPqcenter(path string, M int, dim int) [](*floatMatrix) {
+	pqCenter := make([]*floatMatrix, M)
 	inputFile, inputError := os.Open(path)
 	if inputError != nil {
 		fmt.Printf("An error occurred on opening the inputfile\n" +
@@ -220,9 +303,11 @@ func loadPqcenter(path string, M int) [](*floatVectors) {
 			"Have you got acces to it?\n")
 	}
 	defer inputFile.Close()
-	center := NewFloatVectors()
+	center := NewFloatMatrix(0, dim)
 	row := 0
 	inputReader := csv.NewReader(inputFile)
+	// 分隔行只有一列，为了与量化中心行的列数不同，需要允许每行列数不同
+	inputReader.FieldsPerRecord = -1
 	for {
 		inputString, readerError := inputReader.Read()
 		if readerError == io.EOF {
@@ -230,29 +315,54 @@ func loadPqcenter(path string, M int) [](*floatVectors) {
 		}
 		if len(inputString) == 1 {
 			pqCenter[row] = center
-			center = NewFloatVectors()
+			center = NewFloatMatrix(0, dim)
 			row++
 		} else {
-			inputFloatArray := make([]float64, 0)
-			for _, element := range inputString {
+			inputFloatArray := make([]float64, dim)
+			for i, element := range inputString {
 				inputFloat, _ := strconv.ParseFloat(element, 64)
-				inputFloatArray = append(inputFloatArray, inputFloat)
+				inputFloatArray[i] = inputFloat
 			}
-			vector := NewFloatVector(128)
-			vector.SetVector(inputFloatArray)
-			center.Append(*vector)
+			center.appendFloat64(inputFloatArray)
 		}
 	}
 	return pqCenter
 }
 
 // 随机生成一个(0,1) 的浮点数
-func getRandFloat64() float64{
+func getRandFloat64(random *rand.Rand) float64{
 	for {
-		rand.Seed(time.Now().UnixNano())
-		randFloat := rand.Float64()
+		randFloat := random.Float64()
 		if randFloat != 0.0{
 			return randFloat
 		}
 	}
-}
\ No newline at end of file
+}
+// 返回两个整数中较小的一个
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// bitset 位图，用于表示编号集合
+type bitset []uint64
+
+// 生产一个能容纳编号[0,n)的位图
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+// 把编号id加入集合
+func (pointer bitset) set(id int) {
+	pointer[id/64] |= 1 << uint(id%64)
+}
+
+// 判断编号id是否在集合中
+func (pointer bitset) contains(id int) bool {
+	if id < 0 || id/64 >= len(pointer) {
+		return false
+	}
+	return pointer[id/64]&(1<<uint(id%64)) != 0
+}
@@ -82,7 +82,7 @@ func (pointer *floatVector) SetVector(inputVector []float64) error {
 	return nil
 }
 
-// 求一个向量特征与另一个向量特征的距离
+// 求一个向量特征与另一个向量特征的距离, normal为true时返回余弦相似度，否则返回内积
 func (pointer *floatVector) distance(pointInputVector floatVector, normal bool) (float64, error) {
 	if pointer.GetModule() == 0 || pointInputVector.GetModule() == 0 {
 		return 0, errors.New("存在模为0的向量")
@@ -90,11 +90,15 @@ func (pointer *floatVector) distance(pointInputVector floatVector, normal bool)
 	if pointer.length != pointInputVector.length {
 		return 0, errors.New("向量特征维度不同")
 	}
-	var sum float64
-	for i := 0; i < pointInputVector.length; i++ {
-		sum += pointer.vector[i] * pointInputVector.vector[i]
+	if normal {
+		return Cosine.score(pointer.vector, pointInputVector.vector), nil
 	}
-	return sum, nil
+	return InnerProduct.score(pointer.vector, pointInputVector.vector), nil
+}
+
+// 按度量m求一个向量特征与另一个向量特征的得分，得分越大越近
+func (pointer *floatVector) score(pointInputVector floatVector, m Metric) float64 {
+	return m.score(pointer.vector, pointInputVector.vector)
 }
 
 // 将特征向量转化为String类型